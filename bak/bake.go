@@ -0,0 +1,216 @@
+package bak
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../ter"
+)
+
+// Options of a bake. From and To are chunk coordinates, both included.
+type Options struct {
+	From    [2]int
+	To      [2]int
+	Output  string //directory
+	Workers int
+}
+
+// Region is a stitched grid of chunk maps. Neighbouring chunks share their
+// edge points, so it is (chunks*NBPoints+1) points wide.
+type Region struct {
+	Width  int
+	Depth  int
+	Step   float64 //world units between two points
+	Height []float64
+	Water  []float64
+	Low    float64 //height range, what height.png spans, set by Bake
+	High   float64
+}
+
+// ParseChunk reads a "x,z" chunk coordinate.
+func ParseChunk(value string) ([2]int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return [2]int{}, fmt.Errorf("chunk %q: expected x,z", value)
+	}
+	x, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("chunk %q: %v", value, err)
+	}
+	z, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("chunk %q: %v", value, err)
+	}
+	return [2]int{x, z}, nil
+}
+
+// Generate runs the chunk generator over the chunk range, without OpenGL.
+func Generate(heightMap *ter.HeightMap, options Options) *Region {
+	from := [2]int{minInt(options.From[0], options.To[0]), minInt(options.From[1], options.To[1])}
+	to := [2]int{maxInt(options.From[0], options.To[0]), maxInt(options.From[1], options.To[1])}
+	points := int(heightMap.ChunkNBPoints)
+	region := &Region{
+		Width: (to[0]-from[0]+1)*points + 1,
+		Depth: (to[1]-from[1]+1)*points + 1,
+		Step:  float64(heightMap.ChunkWorldSize) / float64(points),
+	}
+	region.Height = make([]float64, region.Width*region.Depth)
+	region.Water = make([]float64, region.Width*region.Depth)
+
+	jobs := make(chan [2]int)
+	var wait sync.WaitGroup
+	for i := 0; i < maxInt(options.Workers, 1); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for position := range jobs {
+				chunk := ter.Chunk{NBPoints: heightMap.ChunkNBPoints, WorldSize: heightMap.ChunkWorldSize, Position: heightMap.WrapChunk(position)}
+				ter.GenerateChunk(&chunk, heightMap)
+				//a chunk owns its points but the last row and column, which
+				//belong to the next chunk, unless it is the last one
+				offsetX := (position[0] - from[0]) * points
+				offsetZ := (position[1] - from[1]) * points
+				lastX, lastZ := points-1, points-1
+				if position[0] == to[0] {
+					lastX = points
+				}
+				if position[1] == to[1] {
+					lastZ = points
+				}
+				for x := 0; x <= lastX; x++ {
+					for z := 0; z <= lastZ; z++ {
+						i := x + z*(points+1)
+						j := (offsetX + x) + (offsetZ+z)*region.Width
+						region.Height[j] = chunk.Map[i]
+						region.Water[j] = chunk.WaterMap[i]
+					}
+				}
+			}
+		}()
+	}
+	for x := from[0]; x <= to[0]; x++ {
+		for z := from[1]; z <= to[1]; z++ {
+			jobs <- [2]int{x, z}
+		}
+	}
+	close(jobs)
+	wait.Wait()
+	return region
+}
+
+// Bake generates the chunk range and writes, in options.Output:
+// height.png and water.png (16-bit), normal.png, and height.r32 and
+// water.r32 (little endian float32, readable back as a dem node). It returns
+// the region written.
+func Bake(heightMap *ter.HeightMap, options Options) (*Region, error) {
+	region := Generate(heightMap, options)
+	if err := os.MkdirAll(options.Output, 0755); err != nil {
+		return nil, err
+	}
+
+	region.Low, region.High = math.Inf(1), math.Inf(-1)
+	for _, height := range region.Height {
+		region.Low = math.Min(region.Low, height)
+		region.High = math.Max(region.High, height)
+	}
+
+	if err := writeGray16(filepath.Join(options.Output, "height.png"), region.Height, region.Width, region.Low, region.High); err != nil {
+		return nil, err
+	}
+	//water depth is rarely over one unit
+	if err := writeGray16(filepath.Join(options.Output, "water.png"), region.Water, region.Width, 0, 1); err != nil {
+		return nil, err
+	}
+	if err := writeNormals(filepath.Join(options.Output, "normal.png"), region); err != nil {
+		return nil, err
+	}
+	if err := writeRaw(filepath.Join(options.Output, "height.r32"), region.Height); err != nil {
+		return nil, err
+	}
+	if err := writeRaw(filepath.Join(options.Output, "water.r32"), region.Water); err != nil {
+		return nil, err
+	}
+	return region, nil
+}
+
+func writeGray16(file string, values []float64, width int, low float64, high float64) error {
+	img := image.NewGray16(image.Rect(0, 0, width, len(values)/width))
+	scale := 0.0
+	if high > low {
+		scale = 65535.0 / (high - low)
+	}
+	for i, value := range values {
+		gray := math.Max(0, math.Min(65535, (value-low)*scale))
+		img.SetGray16(i%width, i/width, color.Gray16{uint16(gray + 0.5)})
+	}
+	return writePNG(file, img)
+}
+
+// writeNormals encodes the normals of the rendered surface (heights doubled)
+// as rgb = xzy*0.5+0.5, blue is up.
+func writeNormals(file string, region *Region) error {
+	img := image.NewNRGBA(image.Rect(0, 0, region.Width, region.Depth))
+	at := func(x, z int) float64 {
+		x = maxInt(0, minInt(x, region.Width-1))
+		z = maxInt(0, minInt(z, region.Depth-1))
+		return 2 * region.Height[x+z*region.Width]
+	}
+	for x := 0; x < region.Width; x++ {
+		for z := 0; z < region.Depth; z++ {
+			dx := (at(x+1, z) - at(x-1, z)) / (2 * region.Step)
+			dz := (at(x, z+1) - at(x, z-1)) / (2 * region.Step)
+			length := math.Sqrt(dx*dx + dz*dz + 1)
+			img.SetNRGBA(x, z, color.NRGBA{
+				R: uint8(255 * (-dx/length*0.5 + 0.5)),
+				G: uint8(255 * (-dz/length*0.5 + 0.5)),
+				B: uint8(255 * (1/length*0.5 + 0.5)),
+				A: 255,
+			})
+		}
+	}
+	return writePNG(file, img)
+}
+
+func writePNG(file string, img image.Image) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeRaw(file string, values []float64) error {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(value)))
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
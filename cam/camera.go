@@ -3,6 +3,7 @@ package cam
 import (
 	"math"
 
+	"../ctx"
 	"../win"
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/go-gl/mathgl/mgl64"
@@ -115,3 +116,27 @@ func (c *FpsCamera) GetTransform() mgl32.Mat4 {
 func (c *FpsCamera) Position() mgl32.Vec3 {
 	return c.pos
 }
+
+// Front returns the direction the camera looks at.
+func (c *FpsCamera) Front() mgl32.Vec3 {
+	return c.front
+}
+
+// SetPosition moves the camera without turning it
+func (c *FpsCamera) SetPosition(position mgl32.Vec3) {
+	c.pos = position
+}
+
+// Ray unprojects a cursor position, in window pixels, into a world space ray
+// starting on the near plane.
+func (c *FpsCamera) Ray(cursorX, cursorY float64) (mgl32.Vec3, mgl32.Vec3) {
+	inverse := ctx.Projection().Mul4(c.GetTransform()).Inv()
+	x := float32(2*cursorX/float64(ctx.Width()) - 1)
+	y := float32(1 - 2*cursorY/float64(ctx.Height()))
+
+	near := inverse.Mul4x1(mgl32.Vec4{x, y, -1, 1})
+	far := inverse.Mul4x1(mgl32.Vec4{x, y, 1, 1})
+	origin := near.Vec3().Mul(1 / near.W())
+	target := far.Vec3().Mul(1 / far.W())
+	return origin, target.Sub(origin).Normalize()
+}
@@ -0,0 +1,44 @@
+package cam
+
+import (
+	"../ctx"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Frustum holds the left, right, bottom, top, near and far planes of a view
+// projection, as a*x+b*y+c*z+d with the normals pointing inside.
+type Frustum [6]mgl32.Vec4
+
+// NewFrustum extracts the planes from the rows of a view projection matrix
+// (Gribb and Hartmann).
+func NewFrustum(viewProjection mgl32.Mat4) Frustum {
+	rows := [4]mgl32.Vec4{viewProjection.Row(0), viewProjection.Row(1), viewProjection.Row(2), viewProjection.Row(3)}
+	return Frustum{
+		rows[3].Add(rows[0]), rows[3].Sub(rows[0]),
+		rows[3].Add(rows[1]), rows[3].Sub(rows[1]),
+		rows[3].Add(rows[2]), rows[3].Sub(rows[2]),
+	}
+}
+
+// Frustum returns the frustum of the camera with the window projection.
+func (c *FpsCamera) Frustum() Frustum {
+	return NewFrustum(ctx.Projection().Mul4(c.GetTransform()))
+}
+
+// ContainsBox tells if an axis aligned box is at least partly inside. Boxes
+// near a corner may pass while outside, never the other way around.
+func (frustum *Frustum) ContainsBox(min, max mgl32.Vec3) bool {
+	for _, plane := range frustum {
+		//the corner furthest along the plane normal
+		corner := min
+		for axis := 0; axis < 3; axis++ {
+			if plane[axis] > 0 {
+				corner[axis] = max[axis]
+			}
+		}
+		if plane.Vec3().Dot(corner)+plane.W() < 0 {
+			return false
+		}
+	}
+	return true
+}
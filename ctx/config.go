@@ -1,5 +1,7 @@
 package ctx
 
+import "github.com/go-gl/mathgl/mgl32"
+
 var (
 	width  = 1280
 	height = 720
@@ -26,3 +28,8 @@ func Width() int {
 func Height() int {
 	return height
 }
+
+// Projection is the perspective projection of the current window
+func Projection() mgl32.Mat4 {
+	return mgl32.Perspective(mgl32.DegToRad(Fov), float32(width)/float32(height), Near, Far)
+}
@@ -7,6 +7,7 @@ in vec4 MatColor;
 in vec2 TexCoord;
 in float Height;
 in float RiverHeight;
+in vec4 Ground;
 
 out vec4 color;
 
@@ -25,115 +26,27 @@ uniform sampler2D waterTexture; //4
 
 uniform int time;
 
-const float minHeightSnow = 1.4;
-const float maxNormalSnow = -0.9;
-const float maxNormalSnowRock = -0.85;
+//slopes between these normals turn from the biome ground to rock
+const float maxNormalFlat = -0.9;
+const float maxNormalSteep = -0.8;
 
-const float minHeightSnowGrass = 1.3;
+//rendered height of the sea, as chunk.vert floods it
+const float seaHeight = -1.9;
 
-const float minRock = 1.5;
-
-const float minRockDirt = 1.0;
-const float minDirt = -0.5;
-
-const float maxNormalGrass = -0.9;
-const float maxNormalGrassDirt = -0.85;
-
-const float minHeightGrass = -0.5;
-const float minDirtSand = -1.5;
-const float minSand = -2.0;
-
-const float minWater =-2000.0;
-
-//attempt to remove branching
-void setTextureCoefficientsNoBranching(inout float coeffs[5])
-{
-    bool found = false;
-
-    bool snowGrass = Height > minHeightSnowGrass && Height < minHeightSnow && Normal.y < maxNormalSnow || Normal.y < maxNormalGrass;
-    bool snow =      !found && Height > minHeightSnow && Normal.y < maxNormalSnow;
-    found = found || snow;
-    bool snowRock =  !found && Height > minHeightSnow && Normal.y < maxNormalSnowRock;
-    found = found || snowRock;
-    bool grass =     !found && Height > minHeightGrass && Normal.y < maxNormalGrass;
-    found = found || grass;
-    bool grassDirt = !found && Height > minHeightGrass && Normal.y < maxNormalGrassDirt;
-    found = found || grassDirt;
-
-    bool rock =      !found && Height > minRock;
-    found = found || rock;
-    bool rockDirt =  !found && Height > minRockDirt;
-    found = found || rockDirt;
-    bool dirt =      !found && Height > minDirt;
-    found = found || dirt;
-    bool dirtSand =  !found && Height > minDirtSand;
-    found = found || dirtSand;
-    bool sand =      !found && Height > minSand;
-    found = found || sand;
-    bool def = !found;
-
-
-    float a_height_snowgrass = smoothstep(minHeightSnowGrass, minHeightSnow, Height);
-    float a_norm_snowrock = smoothstep(maxNormalSnowRock, maxNormalSnow, Normal.y);
-    float a_norm_grassdirt = smoothstep(maxNormalGrassDirt, maxNormalGrass, Normal.y);
-
-    float a_height_rockdirt = smoothstep(minRockDirt, minRock, Height);
-    float a_height_dirtsand = smoothstep(minDirtSand, minDirt, Height);
-
-    coeffs[0] = 1.0 * int(snow)   + a_height_snowgrass * int(snowGrass)      + a_norm_snowrock * int(snowRock);
-    coeffs[1] = 1.0 * int(rock)   + a_height_rockdirt * int(rockDirt)        +(1 - a_norm_snowrock) * int(snowRock);
-    coeffs[2] = 1.0 * int(dirt)   + (1 - a_height_rockdirt) * int(rockDirt)  +(1 - a_norm_grassdirt)* int(grassDirt) + a_height_dirtsand * int(dirtSand);
-    coeffs[3] = 1.0 * int(grass)  + (1 - a_height_snowgrass) * int(snowGrass)+ a_norm_grassdirt * int(grassDirt);
-    coeffs[4] = 1.0 * int(sand)   + (1 - a_height_dirtsand) * int(dirtSand);
-}
+//water depth under which a river vertex still shows its bed
+const float minRiverDepth = 0.02;
 
+//the ground of the biomes (Ground, grass being what the others leave), rock on
+//steep slopes
 void setTextureCoefficients(inout float coeffs[5])
 {
-    if(Height > minHeightSnowGrass && Height < minHeightSnow && (Normal.y < maxNormalSnow || Normal.y < maxNormalGrass)){
-            float a_height = smoothstep(minHeightSnowGrass, minHeightSnow, Height);
-            coeffs[0] = a_height;
-            coeffs[3] = 1 - a_height;
-            return;
-    }
-    if(Height > minHeightSnow){
-        if(Normal.y < maxNormalSnow){
-            coeffs[0] = 1.0;
-            return;
-        }else if(Normal.y < maxNormalSnowRock){
-            float a = smoothstep(maxNormalSnowRock, maxNormalSnow, Normal.y);
-            coeffs[0] = a;
-            coeffs[1] = 1 - a;
-            return;
-        }
-    }
-    if(Height > minHeightGrass){
-        if(Normal.y < maxNormalGrass){
-            coeffs[3] = 1.0;
-            return;
-        }else if(Normal.y < maxNormalGrassDirt){
-            float a = smoothstep(maxNormalGrassDirt, maxNormalGrass, Normal.y);
-            coeffs[3] = a;
-            coeffs[2] = 1 - a;
-            return;
-        }
-    }
-    if(Height > minRock)
-        coeffs[1] = 1.0;
-    else if (Height > minRockDirt){
-        float a = smoothstep(minRockDirt, minRock, Height);
-        coeffs[1] = a;
-        coeffs[2] = 1 - a;
-    }
-    else if(Height > minDirt)
-        coeffs[2] = 1.0;
-    else if (Height > minDirtSand){
-        float a = smoothstep(minDirtSand, minDirt, Height);
-        coeffs[2] = a;
-        coeffs[4] = 1 - a;
-    }
-    else if(Height > minSand)
-        coeffs[4] = 1.0;
-    else coeffs[0] = 0.1;
+    float grass = max(0.0, 1.0 - Ground.x - Ground.y - Ground.z - Ground.w);
+    float level = 1.0 - smoothstep(maxNormalFlat, maxNormalSteep, Normal.y);
+    coeffs[0] = level * Ground.x;
+    coeffs[1] = level * Ground.y + (1.0 - level);
+    coeffs[2] = level * Ground.z;
+    coeffs[3] = level * grass;
+    coeffs[4] = level * Ground.w;
 }
 
 float LinearizeDepth(float depth)
@@ -152,11 +65,10 @@ void main()
 
     float coeffs[5] = float[5](0.0, 0.0, 0.0, 0.0, 0.0);
     setTextureCoefficients(coeffs);
-    //setTextureCoefficientsNoBranching(coeffs);
     //if water
     if(Normal.y == 0)
     discard;
-    if(RiverHeight > 2.0 /*&& Height < minRock*/ || Height < minSand + 0.1)
+    if(RiverHeight > minRiverDepth || Height < seaHeight)
     {
         float k = 0.1;
         float lambda = 2000;
@@ -210,7 +122,7 @@ void main()
 	float depth = LinearizeDepth(gl_FragCoord.z) / far; // divide by far for demonstration
     color = mix(color, vec4(vec3(depth), 1.0), 0.5);
 
-    //color.b = 1 - smoothstep(-3.0, -1.0, RiverHeight);
+    //color.b = 1 - smoothstep(0.0, 0.1, RiverHeight);
     //norm =
 
 }
@@ -4,12 +4,16 @@ layout (location = 0) in vec3 position;
 layout (location = 1) in vec3 normal;
 layout (location = 2) in vec4 color;
 layout (location = 3) in vec2 texture;
+layout (location = 4) in float morph; //Y offset to the next level of detail
+layout (location = 5) in vec4 ground; //biome material weights: snow, rock, dirt, sand
 
 uniform mat4 model;
 uniform mat4 view;
 uniform mat4 project;
 
 uniform vec3 lightPos;  // only need one light for a basic example
+uniform vec3 cameraPos;
+uniform vec2 morphRange; //distances over which the level morphs into the next
 
 out float RiverHeight;
 out vec3 Normal;
@@ -18,6 +22,7 @@ out vec3 LightPos;
 out vec4 MatColor;
 out vec2 TexCoord;
 out float Height;
+out vec4 Ground;
 
 const float seaLevel = -1.9;
 
@@ -28,7 +33,10 @@ int getTexture()
 void main()
 {
     vec3 pos = position;
-    if(-position.y < seaLevel) pos.y = 2.0;
+    vec4 world = model * vec4(position, 1.0);
+    float k = clamp((length(world.xz - cameraPos.xz) - morphRange.x) / (morphRange.y - morphRange.x), 0.0, 1.0);
+    pos.y += k * morph;
+    if(-pos.y < seaLevel) pos.y = 2.0;
     gl_Position = project * view * model * vec4(pos, 1.0);
     FragPos = gl_Position.xyz;
     LightPos = lightPos;
@@ -39,4 +47,5 @@ void main()
     TexCoord = texture;
     Height = -pos.y;
     RiverHeight = color.a;
+    Ground = ground;
 }
@@ -0,0 +1,344 @@
+package gfx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// ExportMesh is model data as uploaded by LoadModelData, placed in the world
+// by Transform. Texture is the image file of its material, may be empty.
+type ExportMesh struct {
+	Data      *ModelData
+	Transform mgl32.Mat4
+	Texture   string
+}
+
+// exportVertex is a vertex in the exported frame: FillModelData already
+// doubled the heights, exporters flip Y so up is +Y like in most tools. The
+// flip mirrors the mesh, so triangles are written in reverse order.
+type exportVertex struct {
+	Position mgl32.Vec3
+	Normal   mgl32.Vec3
+	Color    mgl32.Vec3 //alpha holds the water depth, not exported
+	Texture  mgl32.Vec2
+}
+
+func (mesh *ExportMesh) vertices() []exportVertex {
+	data := mesh.Data.Vertices
+	vertices := make([]exportVertex, len(data)/12)
+	for i := range vertices {
+		v := data[12*i : 12*i+12]
+		position := mesh.Transform.Mul4x1(mgl32.Vec4{v[0], v[1], v[2], 1}).Vec3()
+		normal := mesh.Transform.Mul4x1(mgl32.Vec4{v[3], v[4], v[5], 0}).Vec3()
+		vertices[i] = exportVertex{
+			Position: mgl32.Vec3{position.X(), -position.Y(), position.Z()},
+			Normal:   mgl32.Vec3{normal.X(), -normal.Y(), normal.Z()},
+			Color:    mgl32.Vec3{v[6], v[7], v[8]},
+			Texture:  mgl32.Vec2{v[10], v[11]},
+		}
+	}
+	return vertices
+}
+
+func (mesh *ExportMesh) triangles() [][3]uint32 {
+	indices := mesh.Data.Connectivity
+	triangles := make([][3]uint32, len(indices)/3-mesh.Data.Skirts)
+	for i := range triangles {
+		triangles[i] = [3]uint32{indices[3*i], indices[3*i+2], indices[3*i+1]}
+	}
+	return triangles
+}
+
+// ExportOBJ writes a Wavefront OBJ with vertex colors, and its MTL next to it
+// with one material per texture.
+func ExportOBJ(file string, meshes []ExportMesh) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	mtlFile := strings.TrimSuffix(file, filepath.Ext(file)) + ".mtl"
+	materials := map[string]string{}
+	var mtl bytes.Buffer
+	fmt.Fprintf(w, "mtllib %s\n", filepath.Base(mtlFile))
+
+	offset := uint32(1)
+	for index, mesh := range meshes {
+		vertices := mesh.vertices()
+		fmt.Fprintf(w, "o mesh%d\n", index)
+		for _, v := range vertices {
+			fmt.Fprintf(w, "v %g %g %g %g %g %g\n", v.Position.X(), v.Position.Y(), v.Position.Z(), v.Color.X(), v.Color.Y(), v.Color.Z())
+		}
+		for _, v := range vertices {
+			fmt.Fprintf(w, "vn %g %g %g\n", v.Normal.X(), v.Normal.Y(), v.Normal.Z())
+		}
+		for _, v := range vertices {
+			fmt.Fprintf(w, "vt %g %g\n", v.Texture.X(), v.Texture.Y())
+		}
+
+		if mesh.Texture != "" {
+			name, ok := materials[mesh.Texture]
+			if !ok {
+				name = fmt.Sprintf("material%d", len(materials))
+				materials[mesh.Texture] = name
+				fmt.Fprintf(&mtl, "newmtl %s\nKd 1 1 1\nmap_Kd %s\n\n", name, relativePath(mtlFile, mesh.Texture))
+			}
+			fmt.Fprintf(w, "usemtl %s\n", name)
+		}
+		for _, tri := range mesh.triangles() {
+			a, b, c := tri[0]+offset, tri[1]+offset, tri[2]+offset
+			fmt.Fprintf(w, "f %d/%d/%d %d/%d/%d %d/%d/%d\n", a, a, a, b, b, b, c, c, c)
+		}
+		offset += uint32(len(vertices))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mtlFile, mtl.Bytes(), 0644)
+}
+
+// relativePath makes target relative to the directory of file when possible,
+// tools resolve material textures from there.
+func relativePath(file string, target string) string {
+	from, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return target
+	}
+	to, err := filepath.Abs(target)
+	if err != nil {
+		return target
+	}
+	relative, err := filepath.Rel(from, to)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(relative)
+}
+
+// ExportSTL writes a binary STL of all the triangles. With base > 0 the
+// surface is closed into a printable solid: walls go down from its open edges
+// to a floor base units under the lowest point. The floor is a fan, so the
+// outline seen from above must be convex, like a rectangle of chunks.
+func ExportSTL(file string, meshes []ExportMesh, base float32) error {
+	var triangles [][3]mgl32.Vec3
+	for _, mesh := range meshes {
+		vertices := mesh.vertices()
+		for _, tri := range mesh.triangles() {
+			triangles = append(triangles, [3]mgl32.Vec3{vertices[tri[0]].Position, vertices[tri[1]].Position, vertices[tri[2]].Position})
+		}
+	}
+	if base > 0 {
+		triangles = append(triangles, closeSurface(triangles, base)...)
+	}
+
+	var buffer bytes.Buffer
+	header := make([]byte, 80)
+	copy(header, "procedural-go terrain")
+	buffer.Write(header)
+	binary.Write(&buffer, binary.LittleEndian, uint32(len(triangles)))
+	for _, tri := range triangles {
+		normal := tri[1].Sub(tri[0]).Cross(tri[2].Sub(tri[0]))
+		if normal.Len() > 0 {
+			normal = normal.Normalize()
+		}
+		binary.Write(&buffer, binary.LittleEndian, normal)
+		binary.Write(&buffer, binary.LittleEndian, tri)
+		binary.Write(&buffer, binary.LittleEndian, uint16(0))
+	}
+	return ioutil.WriteFile(file, buffer.Bytes(), 0644)
+}
+
+// closeSurface returns the walls and floor closing the surface. Chunks do not
+// share vertices, so they are welded by position first: an edge used by a
+// single triangle is on the outline.
+func closeSurface(triangles [][3]mgl32.Vec3, base float32) [][3]mgl32.Vec3 {
+	const weld = 1000.0
+	key := func(v mgl32.Vec3) [3]int64 {
+		return [3]int64{int64(math.Round(float64(v.X()) * weld)), int64(math.Round(float64(v.Y()) * weld)), int64(math.Round(float64(v.Z()) * weld))}
+	}
+	type edge [2][3]int64
+	edges := map[edge]int{}
+	positions := map[[3]int64]mgl32.Vec3{}
+	floor := float32(math.MaxFloat32)
+	for _, tri := range triangles {
+		for i := 0; i < 3; i++ {
+			a, b := key(tri[i]), key(tri[(i+1)%3])
+			positions[a] = tri[i]
+			edges[edge{a, b}]++
+			floor = float32(math.Min(float64(floor), float64(tri[i].Y())))
+		}
+	}
+	floor -= base
+
+	var outline [][2]mgl32.Vec3
+	var center mgl32.Vec3
+	for e := range edges {
+		if edges[edge{e[1], e[0]}] > 0 {
+			continue
+		}
+		outline = append(outline, [2]mgl32.Vec3{positions[e[0]], positions[e[1]]})
+		center = center.Add(positions[e[0]])
+	}
+	if len(outline) == 0 {
+		return nil
+	}
+	center = center.Mul(1 / float32(len(outline)))
+	center[1] = floor
+
+	//the surface has a->b, the wall b->a, the floor b'->a'
+	var closing [][3]mgl32.Vec3
+	for _, e := range outline {
+		a, b := e[0], e[1]
+		lowA := mgl32.Vec3{a.X(), floor, a.Z()}
+		lowB := mgl32.Vec3{b.X(), floor, b.Z()}
+		closing = append(closing, [3]mgl32.Vec3{b, a, lowA}, [3]mgl32.Vec3{b, lowA, lowB}, [3]mgl32.Vec3{center, lowB, lowA})
+	}
+	return closing
+}
+
+// gltf 2.0 document, only what ExportGLB writes
+type gltfDocument struct {
+	Asset       map[string]string `json:"asset"`
+	Scene       int               `json:"scene"`
+	Scenes      []gltfScene       `json:"scenes"`
+	Nodes       []gltfNode        `json:"nodes,omitempty"`
+	Meshes      []gltfMesh        `json:"meshes,omitempty"`
+	Accessors   []gltfAccessor    `json:"accessors,omitempty"`
+	BufferViews []gltfBufferView  `json:"bufferViews,omitempty"`
+	Buffers     []gltfBuffer      `json:"buffers,omitempty"`
+}
+
+type gltfScene struct {
+	Nodes []int `json:"nodes"`
+}
+
+type gltfNode struct {
+	Mesh int    `json:"mesh"`
+	Name string `json:"name,omitempty"`
+}
+
+type gltfMesh struct {
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    int            `json:"indices"`
+}
+
+type gltfAccessor struct {
+	BufferView    int       `json:"bufferView"`
+	ComponentType int       `json:"componentType"`
+	Count         int       `json:"count"`
+	Type          string    `json:"type"`
+	Min           []float32 `json:"min,omitempty"`
+	Max           []float32 `json:"max,omitempty"`
+}
+
+type gltfBufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	Target     int `json:"target,omitempty"`
+}
+
+type gltfBuffer struct {
+	ByteLength int `json:"byteLength"`
+}
+
+const (
+	gltfFloat         = 5126
+	gltfUnsignedInt   = 5125
+	gltfArrayBuffer   = 34962
+	gltfElementBuffer = 34963
+)
+
+// ExportGLB writes a binary glTF 2.0 with one node per mesh, vertex colors
+// and texture coordinates.
+func ExportGLB(file string, meshes []ExportMesh) error {
+	document := gltfDocument{
+		Asset:  map[string]string{"version": "2.0", "generator": "procedural-go"},
+		Scenes: []gltfScene{{Nodes: []int{}}},
+	}
+	var bin bytes.Buffer
+
+	//every attribute gets its own buffer view, all data is 4 bytes aligned
+	addView := func(data interface{}, target int) int {
+		offset := bin.Len()
+		binary.Write(&bin, binary.LittleEndian, data)
+		document.BufferViews = append(document.BufferViews, gltfBufferView{ByteOffset: offset, ByteLength: bin.Len() - offset, Target: target})
+		return len(document.BufferViews) - 1
+	}
+	addAccessor := func(accessor gltfAccessor) int {
+		document.Accessors = append(document.Accessors, accessor)
+		return len(document.Accessors) - 1
+	}
+
+	for index, mesh := range meshes {
+		vertices := mesh.vertices()
+		if len(vertices) == 0 {
+			continue
+		}
+		positions := make([]mgl32.Vec3, len(vertices))
+		normals := make([]mgl32.Vec3, len(vertices))
+		colors := make([]mgl32.Vec3, len(vertices))
+		uvs := make([]mgl32.Vec2, len(vertices))
+		low := []float32{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+		high := []float32{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+		for i, v := range vertices {
+			positions[i] = v.Position
+			normals[i] = v.Normal
+			colors[i] = v.Color
+			uvs[i] = v.Texture
+			for axis := 0; axis < 3; axis++ {
+				low[axis] = float32(math.Min(float64(low[axis]), float64(v.Position[axis])))
+				high[axis] = float32(math.Max(float64(high[axis]), float64(v.Position[axis])))
+			}
+		}
+
+		attributes := map[string]int{
+			"POSITION":   addAccessor(gltfAccessor{addView(positions, gltfArrayBuffer), gltfFloat, len(vertices), "VEC3", low, high}),
+			"NORMAL":     addAccessor(gltfAccessor{addView(normals, gltfArrayBuffer), gltfFloat, len(vertices), "VEC3", nil, nil}),
+			"COLOR_0":    addAccessor(gltfAccessor{addView(colors, gltfArrayBuffer), gltfFloat, len(vertices), "VEC3", nil, nil}),
+			"TEXCOORD_0": addAccessor(gltfAccessor{addView(uvs, gltfArrayBuffer), gltfFloat, len(vertices), "VEC2", nil, nil}),
+		}
+		triangles := mesh.triangles()
+		indices := addAccessor(gltfAccessor{addView(triangles, gltfElementBuffer), gltfUnsignedInt, 3 * len(triangles), "SCALAR", nil, nil})
+
+		document.Meshes = append(document.Meshes, gltfMesh{Primitives: []gltfPrimitive{{Attributes: attributes, Indices: indices}}})
+		document.Nodes = append(document.Nodes, gltfNode{Mesh: len(document.Meshes) - 1, Name: fmt.Sprintf("mesh%d", index)})
+		document.Scenes[0].Nodes = append(document.Scenes[0].Nodes, len(document.Nodes)-1)
+	}
+	if bin.Len() > 0 {
+		document.Buffers = []gltfBuffer{{ByteLength: bin.Len()}}
+	}
+
+	content, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	//chunks are padded to 4 bytes, json with spaces
+	for len(content)%4 != 0 {
+		content = append(content, ' ')
+	}
+
+	var glb bytes.Buffer
+	binary.Write(&glb, binary.LittleEndian, []uint32{0x46546C67, 2, uint32(12 + 8 + len(content) + 8 + bin.Len())})
+	binary.Write(&glb, binary.LittleEndian, []uint32{uint32(len(content)), 0x4E4F534A})
+	glb.Write(content)
+	binary.Write(&glb, binary.LittleEndian, []uint32{uint32(bin.Len()), 0x004E4942})
+	glb.Write(bin.Bytes())
+	return ioutil.WriteFile(file, glb.Bytes(), 0644)
+}
@@ -23,10 +23,17 @@ type Mesh struct {
 	Vertices     []Vertex
 	Connectivity []TriangleConnectivity
 	TextureID    uint32
+	Morph        []float32    //optional, per vertex Y offset to the coarser level of detail
+	Ground       []mgl32.Vec4 //optional, per vertex material weights
+	Skirts       int          //trailing triangles hanging under the edges
 }
 
 type Model struct {
 	VAO          uint32
+	VBO          uint32
+	MorphVBO     uint32
+	GroundVBO    uint32
+	InstanceVBO  uint32 //see ModelToInstanceModel
 	Connectivity uint32
 	TextureID    uint32
 	Program      *Program
@@ -39,6 +46,9 @@ type ModelData struct {
 	Vertices     []float32
 	Connectivity []uint32
 	TextureID    uint32
+	Morph        []float32
+	Ground       []float32
+	Skirts       int //trailing triangles left out of the exports
 }
 
 func FillModelData(mesh *Mesh) *ModelData {
@@ -71,6 +81,17 @@ func FillModelData(mesh *Mesh) *ModelData {
 		data.Connectivity[indice+2] = tri.U2
 	}
 
+	if mesh.Morph != nil {
+		data.Morph = make([]float32, len(mesh.Morph))
+		for i, morph := range mesh.Morph {
+			data.Morph[i] = morph * 2
+		}
+	}
+	for _, ground := range mesh.Ground {
+		data.Ground = append(data.Ground, ground[:]...)
+	}
+	data.Skirts = mesh.Skirts
+
 	data.TextureID = mesh.TextureID
 	return &data
 }
@@ -113,6 +134,25 @@ func LoadModelData(model *Model) {
 		offset += 2 * floatSize
 	}
 
+	//morph offsets in their own buffer, the attribute reads 0 without them
+	var MorphBO uint32
+	if len(model.LoadingData.Morph) > 0 {
+		gl.GenBuffers(1, &MorphBO)
+		gl.BindBuffer(gl.ARRAY_BUFFER, MorphBO)
+		gl.BufferData(gl.ARRAY_BUFFER, len(model.LoadingData.Morph)*floatSize, gl.Ptr(model.LoadingData.Morph), gl.STATIC_DRAW)
+		gl.VertexAttribPointer(4, 1, gl.FLOAT, false, int32(floatSize), gl.PtrOffset(0))
+		gl.EnableVertexAttribArray(4)
+	}
+	//same for the material weights
+	var GroundBO uint32
+	if len(model.LoadingData.Ground) > 0 {
+		gl.GenBuffers(1, &GroundBO)
+		gl.BindBuffer(gl.ARRAY_BUFFER, GroundBO)
+		gl.BufferData(gl.ARRAY_BUFFER, len(model.LoadingData.Ground)*floatSize, gl.Ptr(model.LoadingData.Ground), gl.STATIC_DRAW)
+		gl.VertexAttribPointer(5, 4, gl.FLOAT, false, int32(4*floatSize), gl.PtrOffset(0))
+		gl.EnableVertexAttribArray(5)
+	}
+
 	gl.BindVertexArray(0)
 
 	gl.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, IndexBO)
@@ -122,6 +162,9 @@ func LoadModelData(model *Model) {
 	gl.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, 0)
 
 	model.VAO = VAO
+	model.VBO = VBO
+	model.MorphVBO = MorphBO
+	model.GroundVBO = GroundBO
 	model.Connectivity = IndexBO
 	translate := mgl32.Translate3D(0, 0, 0)
 	model.Transform = translate
@@ -129,6 +172,28 @@ func LoadModelData(model *Model) {
 	model.TextureID = model.LoadingData.TextureID
 }
 
+// DeleteModel frees the OpenGL buffers of a model loaded by LoadModelData
+func DeleteModel(model *Model) {
+	gl.DeleteVertexArrays(1, &model.VAO)
+	gl.DeleteBuffers(1, &model.VBO)
+	if model.MorphVBO != 0 {
+		gl.DeleteBuffers(1, &model.MorphVBO)
+	}
+	if model.GroundVBO != 0 {
+		gl.DeleteBuffers(1, &model.GroundVBO)
+	}
+	gl.DeleteBuffers(1, &model.Connectivity)
+	if model.InstanceVBO != 0 {
+		gl.DeleteBuffers(1, &model.InstanceVBO)
+	}
+	model.VAO, model.VBO, model.MorphVBO, model.GroundVBO, model.InstanceVBO, model.Connectivity = 0, 0, 0, 0, 0, 0
+}
+
+// Bytes returns the size of the data, which is also what LoadModelData uploads.
+func (data *ModelData) Bytes() int {
+	return 4 * (len(data.Vertices) + len(data.Connectivity) + len(data.Morph) + len(data.Ground))
+}
+
 func BuildModel(mesh Mesh) Model {
 	m := Model{}
 	m.LoadingData = FillModelData(&mesh)
@@ -145,10 +210,12 @@ func ModelToInstanceModel(m *Model, transforms []mgl32.Mat4) {
 	sizeMat4 := 4 * 4 * sizeFloat
 	sizeVec4 := 4 * sizeFloat
 
-	var VBO uint32
-	gl.GenBuffers(1, &VBO)
-	gl.BindBuffer(gl.ARRAY_BUFFER, VBO)
-	gl.BufferData(gl.ARRAY_BUFFER, len(transforms)*sizeMat4, gl.Ptr(transforms), gl.STATIC_DRAW)
+	//the instances change often, their buffer is reused
+	if m.InstanceVBO == 0 {
+		gl.GenBuffers(1, &m.InstanceVBO)
+	}
+	gl.BindBuffer(gl.ARRAY_BUFFER, m.InstanceVBO)
+	gl.BufferData(gl.ARRAY_BUFFER, len(transforms)*sizeMat4, gl.Ptr(transforms), gl.DYNAMIC_DRAW)
 
 	VAO := m.VAO
 	gl.BindVertexArray(VAO)
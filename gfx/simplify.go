@@ -0,0 +1,317 @@
+package gfx
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// SimplifyParams bounds a simplification: edges are collapsed until the mesh
+// is down to Triangles, but never once a collapse would move the surface by
+// more than MaxError. Zero leaves a bound out. Meshes that are height fields,
+// like the terrain, set Up so that no triangle folds over seen from above.
+type SimplifyParams struct {
+	Triangles int
+	MaxError  float64 //mesh units, see quadric.error
+	Up        mgl32.Vec3
+}
+
+// quadric is the symmetric 4x4 matrix of Garland and Heckbert, the sum of the
+// squared distances to a set of planes: a2 ab ac ad b2 bc bd c2 cd d2.
+type quadric [10]float64
+
+func planeQuadric(a, b, c mgl32.Vec3) (quadric, bool) {
+	normal := b.Sub(a).Cross(c.Sub(a))
+	if normal.Len() < 1e-12 {
+		return quadric{}, false
+	}
+	normal = normal.Normalize()
+	x, y, z := float64(normal.X()), float64(normal.Y()), float64(normal.Z())
+	d := -(x*float64(a.X()) + y*float64(a.Y()) + z*float64(a.Z()))
+	return quadric{x * x, x * y, x * z, x * d, y * y, y * z, y * d, z * z, z * d, d * d}, true
+}
+
+func (q *quadric) add(other *quadric) {
+	for i := range q {
+		q[i] += other[i]
+	}
+}
+
+// error is the sum of the squared distances from p to the planes of q, it
+// bounds the square of the largest one.
+func (q *quadric) error(p mgl32.Vec3) float64 {
+	x, y, z := float64(p.X()), float64(p.Y()), float64(p.Z())
+	return q[0]*x*x + 2*q[1]*x*y + 2*q[2]*x*z + 2*q[3]*x +
+		q[4]*y*y + 2*q[5]*y*z + 2*q[6]*y +
+		q[7]*z*z + 2*q[8]*z + q[9]
+}
+
+// collapse moves vertex from onto vertex to, costing error.
+type collapse struct {
+	error    float64
+	from, to int32
+	versions [2]uint32
+}
+
+type collapseQueue []collapse
+
+func (queue collapseQueue) Len() int            { return len(queue) }
+func (queue collapseQueue) Less(i, j int) bool  { return queue[i].error < queue[j].error }
+func (queue collapseQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *collapseQueue) Push(x interface{}) { *queue = append(*queue, x.(collapse)) }
+func (queue *collapseQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// simplify collapses the edges of triangles by increasing quadric error and
+// returns the triangles left. Vertices only move onto one of their neighbours,
+// so the kept ones keep their attributes. Vertices on the boundary, edges of a
+// single triangle, never move, so meshes sharing it still match.
+func simplify(positions []mgl32.Vec3, triangles [][3]uint32, params SimplifyParams) [][3]uint32 {
+	if params.Triangles <= 0 && params.MaxError <= 0 {
+		return triangles
+	}
+	triangles = append([][3]uint32(nil), triangles...)
+	quadrics := make([]quadric, len(positions))
+	adjacency := make([][]int32, len(positions))
+	edges := make(map[[2]uint32]int)
+	for t, tri := range triangles {
+		if plane, ok := planeQuadric(positions[tri[0]], positions[tri[1]], positions[tri[2]]); ok {
+			for _, v := range tri {
+				quadrics[v].add(&plane)
+			}
+		}
+		for k, v := range tri {
+			adjacency[v] = append(adjacency[v], int32(t))
+			a, b := v, tri[(k+1)%3]
+			if a > b {
+				a, b = b, a
+			}
+			edges[[2]uint32{a, b}]++
+		}
+	}
+	locked := make([]bool, len(positions))
+	for edge, count := range edges {
+		if count != 2 {
+			locked[edge[0]], locked[edge[1]] = true, true
+		}
+	}
+
+	dead := make([]bool, len(triangles))
+	removed := make([]bool, len(positions))
+	versions := make([]uint32, len(positions))
+	queue := &collapseQueue{}
+	push := func(from, to uint32) {
+		if locked[from] {
+			return
+		}
+		q := quadrics[from]
+		q.add(&quadrics[to])
+		heap.Push(queue, collapse{q.error(positions[to]), int32(from), int32(to), [2]uint32{versions[from], versions[to]}})
+	}
+	for edge := range edges {
+		push(edge[0], edge[1])
+		push(edge[1], edge[0])
+	}
+
+	//neighbours lists the vertices around v, and stamps them with stamp
+	marks := make([]uint32, len(positions))
+	stamp := uint32(0)
+	neighbours := func(v int32) []int32 {
+		stamp++
+		var list []int32
+		for _, t := range adjacency[v] {
+			if dead[t] {
+				continue
+			}
+			for _, w := range triangles[t] {
+				if int32(w) != v && marks[w] != stamp {
+					marks[w] = stamp
+					list = append(list, int32(w))
+				}
+			}
+		}
+		return list
+	}
+	//valid refuses collapses that fold triangles over or pinch the surface
+	valid := func(from, to int32) bool {
+		shared := 0
+		for _, t := range adjacency[from] {
+			tri := triangles[t]
+			if dead[t] {
+				continue
+			}
+			if tri[0] == uint32(to) || tri[1] == uint32(to) || tri[2] == uint32(to) {
+				shared++
+				continue
+			}
+			var before, after [3]mgl32.Vec3
+			for k, v := range tri {
+				before[k] = positions[v]
+				after[k] = positions[v]
+				if int32(v) == from {
+					after[k] = positions[to]
+				}
+			}
+			normalBefore := before[1].Sub(before[0]).Cross(before[2].Sub(before[0]))
+			normalAfter := after[1].Sub(after[0]).Cross(after[2].Sub(after[0]))
+			if normalAfter.Len() < 1e-12 || normalBefore.Normalize().Dot(normalAfter.Normalize()) < 0.2 {
+				return false
+			}
+			if normalBefore.Dot(params.Up)*normalAfter.Dot(params.Up) < 0 || (params.Up != mgl32.Vec3{} && normalAfter.Dot(params.Up) == 0) {
+				return false
+			}
+			//slivers have no reliable normal, the next collapses could flip them
+			longest := math.Max(float64(after[1].Sub(after[0]).Len()), math.Max(float64(after[2].Sub(after[1]).Len()), float64(after[0].Sub(after[2]).Len())))
+			if float64(normalAfter.Len()) < 0.01*longest*longest {
+				return false
+			}
+		}
+		common := 0
+		fromNeighbours := neighbours(from)
+		neighbours(to)
+		for _, w := range fromNeighbours {
+			if marks[w] == stamp {
+				common++
+			}
+		}
+		return common == shared
+	}
+
+	live := len(triangles)
+	for queue.Len() > 0 {
+		if params.Triangles > 0 && live <= params.Triangles {
+			break
+		}
+		next := heap.Pop(queue).(collapse)
+		from, to := next.from, next.to
+		if removed[from] || removed[to] || next.versions != [2]uint32{versions[from], versions[to]} {
+			continue
+		}
+		if params.MaxError > 0 && next.error > params.MaxError*params.MaxError {
+			break
+		}
+		if !valid(from, to) {
+			continue
+		}
+
+		for _, t := range adjacency[from] {
+			tri := &triangles[t]
+			if dead[t] {
+				continue
+			}
+			if tri[0] == uint32(to) || tri[1] == uint32(to) || tri[2] == uint32(to) {
+				dead[t] = true
+				live--
+				continue
+			}
+			for k := range tri {
+				if tri[k] == uint32(from) {
+					tri[k] = uint32(to)
+				}
+			}
+			adjacency[to] = append(adjacency[to], t)
+		}
+		kept := adjacency[to][:0]
+		for _, t := range adjacency[to] {
+			if !dead[t] {
+				kept = append(kept, t)
+			}
+		}
+		adjacency[to] = kept
+		adjacency[from] = nil
+		removed[from] = true
+		quadrics[to].add(&quadrics[from])
+
+		//only the quadric of to changed, the collapses touching it are redone
+		versions[to]++
+		for _, w := range neighbours(to) {
+			push(uint32(to), uint32(w))
+			push(uint32(w), uint32(to))
+		}
+	}
+
+	var result [][3]uint32
+	for t, tri := range triangles {
+		if !dead[t] {
+			result = append(result, tri)
+		}
+	}
+	return result
+}
+
+// compact drops the vertices no triangle uses, it returns the kept ones in
+// order and renumbers the triangles in place.
+func compact(count int, triangles [][3]uint32) []uint32 {
+	remap := make([]int32, count)
+	for i := range remap {
+		remap[i] = -1
+	}
+	var kept []uint32
+	for t := range triangles {
+		for k, v := range triangles[t] {
+			if remap[v] < 0 {
+				remap[v] = int32(len(kept))
+				kept = append(kept, v)
+			}
+			triangles[t][k] = uint32(remap[v])
+		}
+	}
+	return kept
+}
+
+// Simplify returns a simplified copy of mesh. Its Skirts and Ground are kept
+// and Morph is dropped, it no longer matches the triangles.
+func Simplify(mesh *Mesh, params SimplifyParams) Mesh {
+	positions := make([]mgl32.Vec3, len(mesh.Vertices))
+	for i, vertex := range mesh.Vertices {
+		positions[i] = vertex.Position
+	}
+	surface := len(mesh.Connectivity) - mesh.Skirts
+	triangles := make([][3]uint32, len(mesh.Connectivity))
+	for i, tri := range mesh.Connectivity {
+		triangles[i] = [3]uint32{tri.U0, tri.U1, tri.U2}
+	}
+	triangles = append(simplify(positions, triangles[:surface], params), triangles[surface:]...)
+
+	result := Mesh{Test: mesh.Test, TextureID: mesh.TextureID, Skirts: mesh.Skirts}
+	for _, v := range compact(len(mesh.Vertices), triangles) {
+		result.Vertices = append(result.Vertices, mesh.Vertices[v])
+		if mesh.Ground != nil {
+			result.Ground = append(result.Ground, mesh.Ground[v])
+		}
+	}
+	for _, tri := range triangles {
+		result.Connectivity = append(result.Connectivity, TriangleConnectivity{tri[0], tri[1], tri[2]})
+	}
+	return result
+}
+
+// SimplifyModelData is Simplify for model data, as used by the exporters.
+func SimplifyModelData(data *ModelData, params SimplifyParams) *ModelData {
+	const stride = 12
+	count := len(data.Vertices) / stride
+	positions := make([]mgl32.Vec3, count)
+	for i := range positions {
+		positions[i] = mgl32.Vec3{data.Vertices[stride*i], data.Vertices[stride*i+1], data.Vertices[stride*i+2]}
+	}
+	all := len(data.Connectivity) / 3
+	triangles := make([][3]uint32, all)
+	for i := range triangles {
+		triangles[i] = [3]uint32{data.Connectivity[3*i], data.Connectivity[3*i+1], data.Connectivity[3*i+2]}
+	}
+	triangles = append(simplify(positions, triangles[:all-data.Skirts], params), triangles[all-data.Skirts:]...)
+
+	result := &ModelData{TextureID: data.TextureID, Skirts: data.Skirts}
+	for _, v := range compact(count, triangles) {
+		result.Vertices = append(result.Vertices, data.Vertices[stride*v:stride*v+stride]...)
+	}
+	for _, tri := range triangles {
+		result.Connectivity = append(result.Connectivity, tri[0], tri[1], tri[2])
+	}
+	return result
+}
@@ -3,11 +3,15 @@ package main
 import (
 	//"fmt"
 
+	"flag"
 	"log"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
-	"time"
+	"sync/atomic"
 
+	"./bak"
 	"./cam"
 	"./ctx"
 	"./gfx"
@@ -20,7 +24,6 @@ import (
 	"github.com/go-gl/gl/v4.1-core/gl"
 	"github.com/go-gl/glfw/v3.1/glfw"
 	"github.com/go-gl/mathgl/mgl32"
-	"github.com/worldsproject/noiselib"
 )
 
 var mesh gfx.Mesh
@@ -32,9 +35,19 @@ var LOAD_DISTANCE int = 4
 var CHUNK_NB_POINTS uint32 = 512
 var MULTISAMPLING int = 8
 var NUM_WORKERS = 6
-
-// PERLIN CONFIG VARS
-// TODO: MOVE TO JSON AND ADD GUI
+var TERRAIN_GRAPH = "data/terrain/default.json"
+var WORLD_SEED int64 = 0
+var VOLUME_TERRAIN = false
+var EXPORT_DIR = "export"
+var CHUNK_CACHE = "cache"
+var EXPORT_STL_BASE float32 = 0.5
+var EXPORT_SIMPLIFY = 0.0
+var WRAP_CHUNKS = 0
+var EDITS_FILE = "edits/world.edits"
+var HISTORY_MB = 64
+var EVICT_MARGIN = 2 //chunks kept past the load and view distances
+var CPU_BUDGET_MB = 4096
+var GPU_BUDGET_MB = 2048
 
 func init() {
 	// GLFW event handling must be run on the main OS thread
@@ -42,6 +55,29 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bake" {
+		bake(os.Args[2:])
+		return
+	}
+
+	flag.Int64Var(&WORLD_SEED, "seed", WORLD_SEED, "world seed driving every random source")
+	flag.StringVar(&TERRAIN_GRAPH, "graph", TERRAIN_GRAPH, "terrain noise graph")
+	flag.StringVar(&CHUNK_CACHE, "cache", CHUNK_CACHE, "chunk cache directory, empty to disable")
+	flag.BoolVar(&VOLUME_TERRAIN, "volume", VOLUME_TERRAIN, "voxel chunks with overhangs and caves, needs a graph with a density output (see data/terrain/caves.json)")
+	flag.IntVar(&WRAP_CHUNKS, "wrap", WRAP_CHUNKS, "world size in chunks, wrapping on both axes, 0 for an infinite world")
+	flag.StringVar(&EDITS_FILE, "edits", EDITS_FILE, "sculpted terrain file, empty to disable sculpting")
+	flag.IntVar(&CPU_BUDGET_MB, "cpu-mb", CPU_BUDGET_MB, "memory of the chunk arrays over which far chunks are evicted")
+	flag.IntVar(&GPU_BUDGET_MB, "gpu-mb", GPU_BUDGET_MB, "memory of the chunk buffers over which far chunks are evicted")
+	flag.Float64Var(&EXPORT_SIMPLIFY, "export-simplify", EXPORT_SIMPLIFY, "largest distance the exported terrain may move when simplified, 0 to export every point")
+	flag.Parse()
+	if WRAP_CHUNKS > 0 && VOLUME_TERRAIN {
+		log.Fatalln("-wrap and -volume can not be combined, torus noise has no height")
+	}
+	//a chunk must not be loaded twice around the camera
+	if WRAP_CHUNKS > 0 && WRAP_CHUNKS < 2*LOAD_DISTANCE+1 {
+		log.Fatalln("-wrap must be at least", 2*LOAD_DISTANCE+1, "chunks")
+	}
+
 	if err := glfw.Init(); err != nil {
 		log.Fatalln("failed to inifitialize glfw:", err)
 	}
@@ -65,87 +101,119 @@ func main() {
 
 	gl.Enable(gl.MULTISAMPLE)
 
-	var perlin = noiselib.DefaultPerlin()
-	perlin.Seed = 0 * int(time.Now().Unix())
-	perlin.OctaveCount = 14
-	perlin.Frequency = 0.1
-	perlin.Lacunarity = 2.2
-	perlin.Persistence = 0.5
-	perlin.Quality = noiselib.QualitySTD
+	hmap = newHeightMap()
+	if VOLUME_TERRAIN {
+		//without density the voxels only extrude the heightfield
+		if hmap.Density == nil {
+			log.Fatalln("-volume needs a graph with a density output, see data/terrain/caves.json")
+		}
+		hmap.Volume = ter.DefaultVolumeParams()
+	}
+	hmap.Eviction = ter.DefaultEvictionParams()
+	hmap.Eviction.Keep = LOAD_DISTANCE + EVICT_MARGIN
+	if VIEW_DISTANCE > LOAD_DISTANCE {
+		hmap.Eviction.Keep = VIEW_DISTANCE + EVICT_MARGIN
+	}
+	hmap.Eviction.CPUMB, hmap.Eviction.GPUMB = CPU_BUDGET_MB, GPU_BUDGET_MB
+
+	err := programLoop(window)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	hmap = ter.HeightMap{
+func newHeightMap() ter.HeightMap {
+	heightMap := ter.HeightMap{
 		ChunkNBPoints:  CHUNK_NB_POINTS,
 		ChunkWorldSize: 12,
 		NbOctaves:      4,
 		Exponent:       1.0,
+		Seed:           WORLD_SEED,
+		Erosion:        ter.DefaultErosionParams(),
+		Thermal:        ter.DefaultThermalParams(),
+		Rivers:         ter.DefaultRiverParams(),
+		Roads:          ter.DefaultRoadParams(),
+		LOD:            ter.DefaultLODParams(),
+		Wrap:           [2]int{WRAP_CHUNKS, WRAP_CHUNKS},
 	}
 
-	hmap.Perlin = perlin
-
-	hmap.TerrainType = noiselib.DefaultPerlin()
-	hmap.TerrainType.Frequency = 0.05
-	hmap.TerrainType.Persistence = 0.25
-
-	hmap.MountainNoise = noiselib.DefaultRidgedmulti()
-	hmap.MountainNoise.Frequency = 0.05
-	hmap.MountainNoise.OctaveCount = 14
-
-	hmap.MountainScaleBias = noiselib.DefaultScaleBias()
-	hmap.MountainScaleBias.SetSourceModule(0, hmap.MountainNoise)
-	hmap.MountainScaleBias.Scale = 2.3
-	hmap.MountainScaleBias.Bias = 0.0
-
-	hmap.RiverNoise = noiselib.DefaultRidgedmulti()
-	hmap.RiverNoise.Seed = 3
-	hmap.RiverNoise.Frequency = 0.07
-	hmap.RiverNoise.Gain = 1.0
-	hmap.RiverAbs = noiselib.Abs{SourceModule: make([]noiselib.Module, 1)}
-	hmap.RiverAbs.SetSourceModule(0, hmap.RiverNoise)
-
-	removeMountainRivers := noiselib.DefaultSelect()
-	removeMountainRivers.SetBounds(0.3, 1000)
-	removeMountainRivers.SetSourceModule(0.0, noiselib.Constant{0.0})
-	removeMountainRivers.SetSourceModule(1.0, hmap.RiverNoise)
-	removeMountainRivers.SetSourceModule(2.0, hmap.TerrainType)
-	removeMountainRivers.SetEdgeFalloff(0.1)
-
-	hmap.RiverClamp = noiselib.Clamp{SourceModule: make([]noiselib.Module, 1)}
-	hmap.RiverClamp.SetSourceModule(0, removeMountainRivers)
-	hmap.RiverClamp.SetBounds(0.4, 1.0)
-
-	hmap.RiverScaleBias = noiselib.DefaultScaleBias()
-	hmap.RiverScaleBias.SetSourceModule(0, hmap.RiverClamp)
-	hmap.RiverScaleBias.Scale = -3.0
-
-	hmap.PlainNoise = noiselib.DefaultBillow()
-	hmap.PlainNoise.Frequency = 0.001
-
-	hmap.PlainScaleBias = noiselib.DefaultScaleBias()
-	hmap.PlainScaleBias.SetSourceModule(0, hmap.PlainNoise)
-	hmap.PlainScaleBias.Scale = 0.125
-	hmap.PlainScaleBias.Bias = 0.5
-
-	hmap.PlainAndRiver = noiselib.DefaultSelect()
-	hmap.PlainAndRiver.SetSourceModule(0, hmap.RiverScaleBias)
-	hmap.PlainAndRiver.SetSourceModule(1, hmap.PlainScaleBias)
-	hmap.PlainAndRiver.SetSourceModule(2, hmap.RiverClamp)
-	hmap.PlainAndRiver.SetBounds(0, 0.95)
-	hmap.PlainAndRiver.SetEdgeFalloff(0.5)
-
-	hmap.FinalTerrain = noiselib.DefaultSelect()
-	hmap.FinalTerrain.SetSourceModule(0, hmap.MountainScaleBias)
-	//hmap.FinalTerrain.SetSourceModule(1, hmap.PlainScaleBias)
-	hmap.FinalTerrain.SetSourceModule(1, hmap.PlainAndRiver)
-	hmap.FinalTerrain.SetSourceModule(2, hmap.TerrainType)
-	hmap.FinalTerrain.LowerBound = 0.0
-	hmap.FinalTerrain.UpperBound = 1000
-	hmap.FinalTerrain.SetEdgeFalloff(0.7)
-	//hmap.FinalTerrain.SetEdgeFalloff(0.125)
+	graph, err := ter.LoadNoiseGraph(TERRAIN_GRAPH)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := graph.Build(&heightMap); err != nil {
+		log.Fatalln(err)
+	}
+	if EDITS_FILE != "" {
+		heightMap.Edits, err = ter.LoadEditLayer(EDITS_FILE, CHUNK_NB_POINTS)
+		if os.IsNotExist(err) {
+			heightMap.Edits, err = ter.NewEditLayer(CHUNK_NB_POINTS), nil
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if CHUNK_CACHE != "" {
+		heightMap.Store, err = ter.NewChunkStore(CHUNK_CACHE, &heightMap, graph)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return heightMap
+}
 
-	err := programLoop(window)
+//bake writes heightmaps of a chunk range, no window is opened
+func bake(args []string) {
+	flags := flag.NewFlagSet("bake", flag.ExitOnError)
+	flags.Int64Var(&WORLD_SEED, "seed", WORLD_SEED, "world seed driving every random source")
+	flags.StringVar(&TERRAIN_GRAPH, "graph", TERRAIN_GRAPH, "terrain noise graph")
+	flags.IntVar(&WRAP_CHUNKS, "wrap", WRAP_CHUNKS, "world size in chunks, wrapping on both axes, 0 for an infinite world")
+	flags.StringVar(&EDITS_FILE, "edits", EDITS_FILE, "sculpted terrain file, empty to bake the generated terrain")
+	from := flags.String("from", "0,0", "first chunk x,z")
+	to := flags.String("to", "0,0", "last chunk x,z, included")
+	res := flags.Uint("res", uint(CHUNK_NB_POINTS), "points per chunk side")
+	out := flags.String("out", "bake", "output directory")
+	flags.Parse(args)
+
+	options := bak.Options{Output: *out, Workers: NUM_WORKERS}
+	var err error
+	if options.From, err = bak.ParseChunk(*from); err != nil {
+		log.Fatalln(err)
+	}
+	if options.To, err = bak.ParseChunk(*to); err != nil {
+		log.Fatalln(err)
+	}
+
+	CHUNK_NB_POINTS = uint32(*res)
+	heightMap := newHeightMap()
+	region, err := bak.Bake(&heightMap, options)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	log.Printf("baked %dx%d points, height.png spans %v to %v", region.Width, region.Depth, region.Low, region.High)
+}
+
+//placeChunk moves a loaded chunk where it is drawn, see ter.Chunk.DrawPosition
+func placeChunk(chunk *ter.Chunk) {
+	transform := mgl32.Translate3D(float32(chunk.DrawPosition[0])*float32(chunk.WorldSize), 0, float32(chunk.DrawPosition[1])*float32(chunk.WorldSize))
+	for _, model := range chunk.TerrainModels() {
+		model.Transform = transform
+	}
+	if chunk.RoadModel != nil {
+		chunk.RoadModel.Transform = transform
+	}
+}
+
+//saveEdits writes the sculpted terrain to EDITS_FILE
+func saveEdits() {
+	if hmap.Edits == nil {
+		return
+	}
+	if err := hmap.Edits.Save(EDITS_FILE); err != nil {
+		log.Println("edits:", err)
+		return
+	}
+	log.Println("saved edits to", EDITS_FILE)
 }
 
 func getCurrentChunkFromCam(camera cam.FpsCamera, hmap *ter.HeightMap) [2]int {
@@ -212,8 +280,8 @@ func programLoop(window *win.Window) error {
 	var loadList []*ter.Chunk
 	visibilityList = ter.GetVisibilityList(&hmap, mgl32.Vec2{camera.Position().X(), camera.Position().Z()}, VIEW_DISTANCE)
 
-	//create job queue
-	loadQueue := make(chan *ter.Chunk, 1000)
+	//create job queue, nearest chunks first
+	loadQueue := ter.NewLoadQueue(&hmap)
 
 	//start workers
 	for i := 0; i < NUM_WORKERS; i++ {
@@ -221,10 +289,57 @@ func programLoop(window *win.Window) error {
 	}
 
 	step := float32(hmap.ChunkWorldSize) / float32(hmap.ChunkNBPoints)
-	gaia := veg.InitialiseVegetation(step)
+	gaia := veg.InitialiseVegetation(step, hmap.Seed)
+
+	brush := ter.DefaultBrush()
+	//loaded chunks being remeshed after sculpting
+	var remeshing []*ter.Chunk
+	submitRemesh := func(chunk *ter.Chunk) {
+		if chunk.Loading {
+			chunk.NeedsRemesh = true
+			return
+		}
+		chunk.Loading = true
+		atomic.StoreInt32(&chunk.AtomicNeedOpenGLLoading, 0)
+		remeshing = append(remeshing, chunk)
+		loadQueue.Push(chunk)
+	}
+	//chunks that are not loaded get the edits when they are generated
+	remeshChunks := func(positions [][2]int) {
+		for _, position := range positions {
+			if chunk := hmap.Chunks[position]; chunk != nil && chunk.Loaded {
+				submitRemesh(chunk)
+			}
+		}
+	}
+	history := ter.NewHistory(HISTORY_MB << 20)
 
 	loadListChangeFlag := true
 	currentChunkChanged := false
+
+	//generator parameters tuned at runtime, a change generates the world again
+	tunables := []struct {
+		name  string
+		value *float64
+	}{
+		{"erosion", &hmap.Erosion.Erosion},
+		{"talus angle", &hmap.Thermal.TalusAngle},
+		{"river depth", &hmap.Rivers.Depth},
+	}
+	tunable := 0
+	//no worker reads the generator parameters once quiesced
+	quiesce := func() {
+		loadQueue.Reset()
+		remeshing = nil
+	}
+	regenerate := func() {
+		if err := hmap.Regenerate(); err != nil {
+			log.Println("chunk cache:", err)
+			hmap.Store = nil
+		}
+		loadListChangeFlag = true
+		currentChunkChanged = true
+	}
 	dome := sky.CreateDome(programSky, gl.TEXTURE3)
 
 	for !window.ShouldClose() {
@@ -232,42 +347,202 @@ func programLoop(window *win.Window) error {
 
 		for _, chunk := range loadList {
 			if chunk.AtomicNeedOpenGLLoading == 1 && chunk.Loaded == false {
-				gfx.LoadModelData(chunk.Model) //
-				translate := mgl32.Translate3D(float32(chunk.Position[0])*float32(chunk.WorldSize), 0, float32(chunk.Position[1])*float32(chunk.WorldSize))
-				chunk.Model.Transform = translate
-				chunk.Model.Program = programChunk
+				for _, model := range chunk.TerrainModels() {
+					gfx.LoadModelData(model)
+					model.Program = programChunk
+				}
+				if chunk.RoadModel != nil {
+					gfx.LoadModelData(chunk.RoadModel)
+					chunk.RoadModel.Program = programBasic
+				}
+				placeChunk(chunk)
 				chunk.Loaded = true //should not need to change other flags if this one is set
+				chunk.Loading = false //free for remeshing and eviction
 				loadListChangeFlag = true
 				gaia.CreateChunkVegetation(chunk, currentChunk)
 			}
 		}
 
+		//swap in the remeshed chunks
+		var resubmit []*ter.Chunk
+		pending := remeshing[:0]
+		for _, chunk := range remeshing {
+			if atomic.LoadInt32(&chunk.AtomicNeedOpenGLLoading) == 0 {
+				pending = append(pending, chunk)
+				continue
+			}
+			old := chunk.SwapRemesh()
+			for _, model := range chunk.TerrainModels() {
+				gfx.LoadModelData(model)
+				model.Program = programChunk
+			}
+			if chunk.RoadModel != nil {
+				gfx.LoadModelData(chunk.RoadModel)
+				chunk.RoadModel.Program = programBasic
+			}
+			placeChunk(chunk)
+			for _, model := range old {
+				gfx.DeleteModel(model)
+			}
+			chunk.Loading = false
+			//the redraw below drops the vegetation of the old terrain
+			gaia.CreateChunkVegetation(chunk, currentChunk)
+			currentChunkChanged = true
+			if chunk.NeedsRemesh {
+				chunk.NeedsRemesh = false
+				resubmit = append(resubmit, chunk)
+			}
+		}
+		remeshing = pending
+		for _, chunk := range resubmit {
+			submitRemesh(chunk)
+		}
+
+		//on wrapping worlds the camera jumps back into the world, a whole world
+		//away, and the chunks are drawn around it again below
+		if x, z, moved := hmap.WrapWorld(float64(camera.Position().X()), float64(camera.Position().Z())); moved {
+			camera.SetPosition(mgl32.Vec3{float32(x), camera.Position().Y(), float32(z)})
+		}
+
 		if currentChunk != getCurrentChunkFromCam(*camera, &hmap) {
 			currentChunk = getCurrentChunkFromCam(*camera, &hmap)
 			loadListChangeFlag = true
 			currentChunkChanged = true
+			resident := hmap.Residency()
+			log.Println("resident", resident.Chunks, "chunks,", resident.CPUBytes>>20, "MB arrays,", resident.GPUBytes>>20, "MB buffers")
 		}
 
 		if loadListChangeFlag {
 			loadList = ter.GetLoadList(&hmap, mgl32.Vec2{camera.Position().X(), camera.Position().Z()}, LOAD_DISTANCE)
 			visibilityList = ter.GetVisibilityList(&hmap, mgl32.Vec2{camera.Position().X(), camera.Position().Z()}, VIEW_DISTANCE)
+			for _, chunk := range visibilityList {
+				if chunk.Loaded {
+					placeChunk(chunk)
+				}
+			}
+			//sort the pending jobs for the new position, before adding the new ones
+			if stopped := loadQueue.Focus(camera.Position(), camera.Front(), currentChunk, LOAD_DISTANCE); len(stopped) > 0 {
+				log.Println("dropped", len(stopped), "chunk loads out of range")
+			}
 			//submit loading jobs
 			for _, chunk := range loadList {
 				if !chunk.Loaded && !chunk.Loading {
 					chunk.Loading = true
-					loadQueue <- chunk
+					loadQueue.Push(chunk)
 				}
 			}
+			if evicted, resident := hmap.Evict(currentChunk); evicted > 0 {
+				log.Println("evicted", evicted, "chunks, resident", resident.Chunks, "chunks,", resident.CPUBytes>>20, "MB arrays,", resident.GPUBytes>>20, "MB buffers")
+			}
 			loadListChangeFlag = false
 		}
 
 		renderList = ter.GetRenderList(&hmap, visibilityList, *camera)
 
+		if window.InputManager().IsKeyTriggered(win.ProgramExport) {
+			exportChunks(renderList, &chunkTextures)
+		}
+
+		if window.InputManager().IsButtonTriggered(win.MouseRight) {
+			cursor := window.InputManager().CursorPosition()
+			origin, direction := camera.Ray(cursor[0], cursor[1])
+			if hit, ok := hmap.Raycast(origin, direction, ctx.Far); ok {
+				log.Println("picked", hit.Position, "height", hit.Height, "chunk", hit.Chunk, ter.Biomes[hit.Biome].Name)
+			}
+		}
+
+		change := ter.BrushChange{Brush: brush, Before: *brush, After: *brush}
+		for tool, key := range []win.ActionKey{win.BrushRaise, win.BrushLower, win.BrushFlatten, win.BrushSmooth, win.BrushNoise} {
+			if window.InputManager().IsKeyTriggered(key) {
+				change.After.Tool = ter.BrushTool(tool)
+			}
+		}
+		if window.InputManager().IsKeyTriggered(win.BrushGrow) {
+			change.After.Radius *= 1.25
+		}
+		if window.InputManager().IsKeyTriggered(win.BrushShrink) {
+			change.After.Radius /= 1.25
+		}
+		if change.After != change.Before {
+			change.Redo()
+			history.Push(&change)
+			log.Println("brush", ter.BrushToolNames[brush.Tool], "radius", brush.Radius)
+		}
+
+		if window.InputManager().IsKeyTriggered(win.ParamNext) {
+			tunable = (tunable + 1) % len(tunables)
+			log.Println("parameter", tunables[tunable].name, *tunables[tunable].value)
+		}
+		scale := 1.0
+		if window.InputManager().IsKeyTriggered(win.ParamUp) {
+			scale = 1.25
+		}
+		if window.InputManager().IsKeyTriggered(win.ParamDown) {
+			scale = 0.8
+		}
+		if scale != 1 {
+			value := tunables[tunable].value
+			change := &ter.ParamChange{Value: value, Before: *value, After: *value * scale, Quiesce: quiesce, Regenerate: regenerate}
+			change.Redo()
+			history.Push(change)
+			log.Println("parameter", tunables[tunable].name, *value, "regenerating")
+		}
+
+		place := window.InputManager().IsKeyTriggered(win.TreePlace)
+		remove := window.InputManager().IsKeyTriggered(win.TreeRemove)
+		if place || remove {
+			cursor := window.InputManager().CursorPosition()
+			origin, direction := camera.Ray(cursor[0], cursor[1])
+			if hit, ok := hmap.Raycast(origin, direction, ctx.Far); ok {
+				if change := hmap.Plant(float64(hit.Position.X()), float64(hit.Position.Z()), place); change != nil {
+					remeshChunks(change.Redo())
+					history.Push(change)
+				}
+			}
+		}
+
+		if window.InputManager().IsButtonActive(win.MouseMiddle) && hmap.Edits != nil {
+			if !hmap.Edits.Stroking() {
+				hmap.Edits.BeginStroke()
+			}
+			cursor := window.InputManager().CursorPosition()
+			origin, direction := camera.Ray(cursor[0], cursor[1])
+			if hit, ok := hmap.Raycast(origin, direction, ctx.Far); ok {
+				remeshChunks(hmap.Sculpt(brush, float64(hit.Position.X()), float64(hit.Position.Z()), window.SinceLastFrame()))
+			}
+		} else if hmap.Edits != nil && hmap.Edits.Stroking() {
+			if stroke := hmap.Edits.EndStroke(); stroke != nil {
+				history.Push(stroke)
+			}
+		}
+
+		//ctrl+z and ctrl+y, not in the middle of a stroke
+		undo := window.InputManager().IsKeyTriggered(win.ProgramUndo)
+		redo := window.InputManager().IsKeyTriggered(win.ProgramRedo)
+		if window.InputManager().IsKeyActive(win.ProgramControl) && !window.InputManager().IsButtonActive(win.MouseMiddle) {
+			if undo {
+				if chunks, ok := history.Undo(); ok {
+					remeshChunks(chunks)
+					log.Println("undo, history", history.Bytes()/1024, "KB")
+				}
+			}
+			if redo {
+				if chunks, ok := history.Redo(); ok {
+					remeshChunks(chunks)
+					log.Println("redo, history", history.Bytes()/1024, "KB")
+				}
+			}
+		}
+
+		if window.InputManager().IsKeyTriggered(win.ProgramSave) {
+			saveEdits()
+		}
+
 		if currentChunkChanged {
-			gaia.ResetInstanceTransfoms()
-			gaia.RedrawAllChunks(renderList, currentChunk)
+			gaia.RedrawAllChunks(visibilityList, currentChunk)
 			currentChunkChanged = false
 		}
+		gaia.Cull(renderList)
 
 		window.StartFrame()
 		camera.Update(window.SinceLastFrame())
@@ -278,6 +553,7 @@ func programLoop(window *win.Window) error {
 
 		chunkTextures.Bind()
 		scr.RenderChunks(renderList, camera, programChunk, &chunkTextures, dome)
+		scr.RenderRoads(renderList, camera, dome)
 		chunkTextures.Unbind()
 
 		for index, leavesTexture := range leavesTextures {
@@ -295,5 +571,46 @@ func programLoop(window *win.Window) error {
 		textureSky.UnBind()
 	}
 
+	if hmap.Edits != nil && len(hmap.Edits.Tiles) > 0 {
+		saveEdits()
+	}
 	return nil
 }
+
+//exportChunks writes the rendered chunks to EXPORT_DIR as OBJ, STL and glTF
+func exportChunks(chunks []*ter.Chunk, textures *ter.ChunkTextureContainer) {
+	var meshes []gfx.ExportMesh
+	for _, chunk := range chunks {
+		data := chunk.Model.LoadingData
+		if EXPORT_SIMPLIFY > 0 {
+			data = gfx.SimplifyModelData(data, gfx.SimplifyParams{MaxError: EXPORT_SIMPLIFY, Up: mgl32.Vec3{0, -1, 0}})
+		}
+		meshes = append(meshes, gfx.ExportMesh{
+			Data:      data,
+			Transform: chunk.Model.Transform,
+			Texture:   textures.TextureFile(chunk.Model.TextureID),
+		})
+		if chunk.RoadModel != nil {
+			meshes = append(meshes, gfx.ExportMesh{
+				Data:      chunk.RoadModel.LoadingData,
+				Transform: chunk.RoadModel.Transform,
+				Texture:   textures.TextureFile(chunk.RoadModel.TextureID),
+			})
+		}
+	}
+
+	if err := os.MkdirAll(EXPORT_DIR, 0755); err != nil {
+		log.Println("export:", err)
+		return
+	}
+	if err := gfx.ExportOBJ(filepath.Join(EXPORT_DIR, "terrain.obj"), meshes); err != nil {
+		log.Println("export:", err)
+	}
+	if err := gfx.ExportSTL(filepath.Join(EXPORT_DIR, "terrain.stl"), meshes, EXPORT_STL_BASE); err != nil {
+		log.Println("export:", err)
+	}
+	if err := gfx.ExportGLB(filepath.Join(EXPORT_DIR, "terrain.glb"), meshes); err != nil {
+		log.Println("export:", err)
+	}
+	log.Println("exported", len(meshes), "chunks to", EXPORT_DIR)
+}
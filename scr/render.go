@@ -16,9 +16,21 @@ import (
 )
 
 func RenderChunks(chunks []*ter.Chunk, camera *cam.FpsCamera, program *gfx.Program, textureContainer *ter.ChunkTextureContainer, dome *sky.Dome) {
+	program.Use()
+	gl.Uniform3f(program.GetUniformLocation("cameraPos"), camera.Position().X(), camera.Position().Y(), camera.Position().Z())
+	for _, chunk := range chunks {
+		model := chunk.DrawModel()
+		model.Program = program
+		gl.Uniform2f(program.GetUniformLocation("morphRange"), chunk.MorphRange[0], chunk.MorphRange[1])
+		RenderChunkModel(model, camera, textureContainer, dome)
+	}
+}
+
+func RenderRoads(chunks []*ter.Chunk, camera *cam.FpsCamera, dome *sky.Dome) {
 	for _, chunk := range chunks {
-		chunk.Model.Program = program
-		RenderChunkModel(chunk.Model, camera, textureContainer, dome)
+		if chunk.RoadModel != nil {
+			RenderModel(chunk.RoadModel, camera, dome)
+		}
 	}
 }
 
@@ -126,8 +138,7 @@ func RenderInstances(m *gfx.Model, camera *cam.FpsCamera, dome *sky.Dome, nbrIns
 
 func initialiseUniforms(m *gfx.Model, camera *cam.FpsCamera, dome *sky.Dome) {
 	view := camera.GetTransform()
-	project := mgl32.Perspective(mgl32.DegToRad(ctx.Fov),
-		float32(ctx.Width())/float32(ctx.Height()), ctx.Near, ctx.Far)
+	project := ctx.Projection()
 
 	gl.Uniform1i(m.Program.GetUniformLocation("currentTexture"), int32(m.TextureID-gl.TEXTURE0))
 	gl.Uniform1f(m.Program.GetUniformLocation("near"), ctx.Near)
@@ -143,7 +154,7 @@ func initialiseUniforms(m *gfx.Model, camera *cam.FpsCamera, dome *sky.Dome) {
 
 func getPVM(m *gfx.Model, camera *cam.FpsCamera) mgl32.Mat4 {
 	view := camera.GetTransform()
-	project := mgl32.Perspective(mgl32.DegToRad(ctx.Fov), float32(ctx.Width())/float32(ctx.Height()), ctx.Near, ctx.Far)
+	project := ctx.Projection()
 	model := m.Transform
 	return project.Mul4(view).Mul4(model)
 }
@@ -0,0 +1,158 @@
+package ter
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+type BiomeID uint8
+
+const (
+	BiomeOcean BiomeID = iota
+	BiomeBeach
+	BiomeIce
+	BiomeTundra
+	BiomeTaiga
+	BiomeGrassland
+	BiomeTemperateForest
+	BiomeTemperateRainforest
+	BiomeDesert
+	BiomeSavanna
+	BiomeTropicalForest
+	BiomeRainforest
+)
+
+type Ground int
+
+const (
+	GroundGrass Ground = iota
+	GroundSand
+	GroundSnow
+	GroundRock
+	GroundDirt
+)
+
+// Weights is the material of a ground as chunk.frag blends them: snow, rock,
+// dirt and sand, grass being what they leave.
+func (ground Ground) Weights() mgl32.Vec4 {
+	switch ground {
+	case GroundSnow:
+		return mgl32.Vec4{1, 0, 0, 0}
+	case GroundRock:
+		return mgl32.Vec4{0, 1, 0, 0}
+	case GroundDirt:
+		return mgl32.Vec4{0, 0, 1, 0}
+	case GroundSand:
+		return mgl32.Vec4{0, 0, 0, 1}
+	}
+	return mgl32.Vec4{}
+}
+
+type Biome struct {
+	Name         string
+	Color        mgl32.Vec4 //flat color, without textures
+	Ground       Ground
+	TreeDensity  float32 //chance for a tree slot to get a tree
+	GrassDensity float32 //chance for a vertex to get a grass blade
+}
+
+var Biomes = []Biome{
+	BiomeOcean:               {"ocean", mgl32.Vec4{0.0, 0.2, 0.5, 1.0}, GroundSand, 0.0, 0.0},
+	BiomeBeach:               {"beach", mgl32.Vec4{0.8, 0.75, 0.5, 1.0}, GroundSand, 0.0, 0.0},
+	BiomeIce:                 {"ice", mgl32.Vec4{0.95, 0.95, 1.0, 1.0}, GroundSnow, 0.0, 0.0},
+	BiomeTundra:              {"tundra", mgl32.Vec4{0.6, 0.6, 0.5, 1.0}, GroundDirt, 0.02, 0.01},
+	BiomeTaiga:               {"taiga", mgl32.Vec4{0.3, 0.45, 0.35, 1.0}, GroundDirt, 0.4, 0.01},
+	BiomeGrassland:           {"grassland", mgl32.Vec4{0.45, 0.6, 0.25, 1.0}, GroundGrass, 0.03, 0.04},
+	BiomeTemperateForest:     {"temperate forest", mgl32.Vec4{0.25, 0.5, 0.2, 1.0}, GroundGrass, 0.35, 0.02},
+	BiomeTemperateRainforest: {"temperate rainforest", mgl32.Vec4{0.15, 0.45, 0.25, 1.0}, GroundGrass, 0.6, 0.02},
+	BiomeDesert:              {"desert", mgl32.Vec4{0.85, 0.7, 0.4, 1.0}, GroundSand, 0.0, 0.0},
+	BiomeSavanna:             {"savanna", mgl32.Vec4{0.7, 0.65, 0.3, 1.0}, GroundGrass, 0.05, 0.03},
+	BiomeTropicalForest:      {"tropical forest", mgl32.Vec4{0.3, 0.55, 0.15, 1.0}, GroundGrass, 0.45, 0.02},
+	BiomeRainforest:          {"rainforest", mgl32.Vec4{0.1, 0.45, 0.1, 1.0}, GroundGrass, 0.7, 0.01},
+}
+
+// SeaLevel in heightmap units. chunk.vert floods everything whose rendered
+// height (*2) is under -1.9.
+const SeaLevel = -0.95
+
+// BeachHeight is how far above the sea level beaches go.
+const BeachHeight = 0.1
+
+// TemperatureLapse is how much the temperature drops per heightmap unit above
+// the sea level.
+const TemperatureLapse = 0.5
+
+// whittaker is indexed by [temperature band][moisture band], cold and dry first.
+var whittaker = [4][4]BiomeID{
+	{BiomeTundra, BiomeTundra, BiomeIce, BiomeIce},
+	{BiomeGrassland, BiomeTaiga, BiomeTaiga, BiomeTaiga},
+	{BiomeGrassland, BiomeTemperateForest, BiomeTemperateForest, BiomeTemperateRainforest},
+	{BiomeDesert, BiomeSavanna, BiomeTropicalForest, BiomeRainforest},
+}
+
+// BiomeFor picks a biome from a height and the raw temperature and moisture
+// noise values (roughly -1..1).
+func BiomeFor(height float64, temperature float64, moisture float64) BiomeID {
+	if height < SeaLevel {
+		return BiomeOcean
+	}
+	if height < SeaLevel+BeachHeight {
+		return BiomeBeach
+	}
+	temperature -= TemperatureLapse * (height - SeaLevel)
+	return whittaker[biomeBand(temperature)][biomeBand(moisture)]
+}
+
+func biomeBand(value float64) int {
+	band := int((value + 1.0) * 2.0)
+	if band < 0 {
+		return 0
+	}
+	if band > 3 {
+		return 3
+	}
+	return band
+}
+
+// biomeStride is the spacing in points of the temperature and moisture
+// samples, both fields are low frequency so they are interpolated in between.
+const biomeStride = 8
+
+// fillBiomeMap computes a biome per vertex from chunk.Map.
+func fillBiomeMap(chunk *Chunk, heightMap *HeightMap) {
+	points := int(chunk.NBPoints) + 1
+	chunk.BiomeMap = make([]BiomeID, points*points)
+
+	coarse := (points-1)/biomeStride + 2
+	temperature := make([]float64, coarse*coarse)
+	moisture := make([]float64, coarse*coarse)
+	step := float64(chunk.WorldSize) / float64(chunk.NBPoints)
+	for x := 0; x < coarse; x++ {
+		for z := 0; z < coarse; z++ {
+			posX := float64(chunk.Position[0])*float64(chunk.WorldSize) + float64(x*biomeStride)*step
+			posZ := float64(chunk.Position[1])*float64(chunk.WorldSize) + float64(z*biomeStride)*step
+			if heightMap.Temperature != nil {
+				temperature[x+z*coarse] = heightMap.Temperature.GetValue(posX, 0, posZ)
+			}
+			if heightMap.Moisture != nil {
+				moisture[x+z*coarse] = heightMap.Moisture.GetValue(posX, 0, posZ)
+			}
+		}
+	}
+
+	for x := 0; x < points; x++ {
+		for z := 0; z < points; z++ {
+			cx, cz := x/biomeStride, z/biomeStride
+			fx := float64(x%biomeStride) / biomeStride
+			fz := float64(z%biomeStride) / biomeStride
+			t := bilinear(temperature, coarse, cx, cz, fx, fz)
+			m := bilinear(moisture, coarse, cx, cz, fx, fz)
+			i := x + z*points
+			chunk.BiomeMap[i] = BiomeFor(chunk.Map[i], t, m)
+		}
+	}
+}
+
+func bilinear(field []float64, size int, cellX, cellZ int, x, z float64) float64 {
+	i := cellX + cellZ*size
+	return field[i]*(1-x)*(1-z) + field[i+1]*x*(1-z) + field[i+size]*(1-x)*z + field[i+size+1]*x*z
+}
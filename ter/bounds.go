@@ -0,0 +1,34 @@
+package ter
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// vegetationMargin is how far above the ground the vegetation of a chunk may
+// reach, world units. The bounds also keep a small margin for the skirts, the
+// morphing and the roads.
+const vegetationMargin = 3.0
+const groundMargin = 0.5
+
+// fillHeightRange keeps the lowest and highest heights of Map, and of the lake
+// surfaces drawn over it.
+func fillHeightRange(chunk *Chunk) {
+	low, high := math.Inf(1), math.Inf(-1)
+	for i, height := range chunk.Map {
+		low = math.Min(low, height)
+		high = math.Max(high, math.Max(height, chunk.LakeMap[i]))
+	}
+	chunk.HeightRange = [2]float64{low, high}
+}
+
+// Bounds returns the world box of the chunk drawn at DrawPosition, its
+// vegetation included. Drawn heights are doubled and go down the Y axis.
+func (chunk *Chunk) Bounds() (mgl32.Vec3, mgl32.Vec3) {
+	size := float32(chunk.WorldSize)
+	x, z := float32(chunk.DrawPosition[0])*size, float32(chunk.DrawPosition[1])*size
+	min := mgl32.Vec3{x - groundMargin, float32(-2*chunk.HeightRange[1]) - vegetationMargin, z - groundMargin}
+	max := mgl32.Vec3{x + size + groundMargin, float32(-2*chunk.HeightRange[0]) + groundMargin, z + size + groundMargin}
+	return min, max
+}
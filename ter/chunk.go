@@ -2,15 +2,15 @@ package ter
 
 import (
 	"fmt"
+	"log"
 	"math"
-	"math/rand"
-	"sync/atomic"
+	"sort"
+	"time"
 
 	"../cam"
 	"../gfx"
 
 	"github.com/go-gl/gl/v4.1-core/gl"
-	"github.com/go-gl/glfw/v3.1/glfw"
 	"github.com/go-gl/mathgl/mgl32"
 )
 
@@ -18,20 +18,35 @@ type Chunk struct {
 	NBPoints        uint32
 	WorldSize       uint32
 	Position        [2]int
+	DrawPosition    [2]int //Position, or its copy near the camera on wrapping worlds
 	Map             []float64
 	WaterMap        []float64
+	LakeMap         []float64 //lake surface height, NoLake on dry land
 	NormalY			[]float64
+	Rim             []float64 //heights just past the edges, see rimIndex
+	BiomeMap        []BiomeID
+	HeightRange     [2]float64 //lowest and highest height, see Bounds
 	Model           *gfx.Model
+	RoadModel       *gfx.Model //nil without roads
+	LODModels       []*gfx.Model //level 0 is Model, nil without levels of detail
+	LOD             int
+	MorphRange      [2]float32 //distances over which LOD morphs into the next level
 	GrassTransforms []mgl32.Mat4
 	TreesTransforms []mgl32.Mat4
+	TreesBiome      []BiomeID
 	TreesModelID    []int
+	Edits           []float64 //sculpted deltas already in Map, nil without edits
 	IsHQ            bool
 	HasVegetation   bool
+	LastSeen        time.Time //last frame in the visibility list, see Evict
 
 	//loading related flags
 	Loaded                  bool
 	Loading                 bool
 	AtomicNeedOpenGLLoading int32
+	AtomicCancelled         int32 //set by LoadQueue.Focus, see Cancelled
+	Remesh                  *ChunkRemesh //set by the worker remeshing a loaded chunk
+	NeedsRemesh             bool         //edited again while remeshing
 }
 
 type ChunkTextureContainer struct {
@@ -41,6 +56,7 @@ type ChunkTextureContainer struct {
 	Grass *gfx.Texture
 	Rock  *gfx.Texture
 	Water *gfx.Texture
+	Road  *gfx.Texture
 
 	DirtID  uint32
 	SandID  uint32
@@ -48,46 +64,88 @@ type ChunkTextureContainer struct {
 	GrassID uint32
 	RockID  uint32
 	WaterID uint32
+	RoadID  uint32
 }
 
 func LoadChunkTextures() ChunkTextureContainer {
 	container := ChunkTextureContainer{}
 	var err error
 
-	container.Dirt, err = gfx.NewTextureFromFile("data/textures/chunks/dirt.jpg", gl.REPEAT, gl.REPEAT)
+	container.DirtID = gl.TEXTURE3
+	container.SandID = gl.TEXTURE4
+	container.SnowID = gl.TEXTURE5
+	container.GrassID = gl.TEXTURE6
+	container.RockID = gl.TEXTURE7
+	container.WaterID = gl.TEXTURE8
+	container.RoadID = gl.TEXTURE9
+
+	container.Dirt, err = gfx.NewTextureFromFile(container.TextureFile(container.DirtID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-	container.Snow, err = gfx.NewTextureFromFile("data/textures/chunks/snow.jpg", gl.REPEAT, gl.REPEAT)
+	container.Snow, err = gfx.NewTextureFromFile(container.TextureFile(container.SnowID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-	container.Grass, err = gfx.NewTextureFromFile("data/textures/chunks/grass.jpg", gl.REPEAT, gl.REPEAT)
+	container.Grass, err = gfx.NewTextureFromFile(container.TextureFile(container.GrassID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-	container.Rock, err = gfx.NewTextureFromFile("data/textures/chunks/rock.jpg", gl.REPEAT, gl.REPEAT)
+	container.Rock, err = gfx.NewTextureFromFile(container.TextureFile(container.RockID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-	container.Sand, err = gfx.NewTextureFromFile("data/textures/chunks/sand.jpg", gl.REPEAT, gl.REPEAT)
+	container.Sand, err = gfx.NewTextureFromFile(container.TextureFile(container.SandID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-	container.Water, err = gfx.NewTextureFromFile("data/textures/chunks/water.jpg", gl.REPEAT, gl.REPEAT)
+	container.Water, err = gfx.NewTextureFromFile(container.TextureFile(container.WaterID), gl.REPEAT, gl.REPEAT)
+	if err != nil {
+		panic(err.Error())
+	}
+	container.Road, err = gfx.NewTextureFromFile(container.TextureFile(container.RoadID), gl.REPEAT, gl.REPEAT)
 	if err != nil {
 		panic(err.Error())
 	}
-
-	container.DirtID = gl.TEXTURE3
-	container.SandID = gl.TEXTURE4
-	container.SnowID = gl.TEXTURE5
-	container.GrassID = gl.TEXTURE6
-	container.RockID = gl.TEXTURE7
-	container.WaterID = gl.TEXTURE8
 	return container
 }
 
+// TextureFile returns the image bound to a texture unit, exporters use it for
+// the materials.
+func (container *ChunkTextureContainer) TextureFile(textureID uint32) string {
+	switch textureID {
+	case container.DirtID:
+		return "data/textures/chunks/dirt.jpg"
+	case container.SandID:
+		return "data/textures/chunks/sand.jpg"
+	case container.SnowID:
+		return "data/textures/chunks/snow.jpg"
+	case container.GrassID:
+		return "data/textures/chunks/grass.jpg"
+	case container.RockID:
+		return "data/textures/chunks/rock.jpg"
+	case container.WaterID:
+		return "data/textures/chunks/water.jpg"
+	case container.RoadID:
+		return "data/textures/roads/road.jpg"
+	}
+	return ""
+}
+
+func (container *ChunkTextureContainer) GroundID(ground Ground) uint32 {
+	switch ground {
+	case GroundSand:
+		return container.SandID
+	case GroundSnow:
+		return container.SnowID
+	case GroundRock:
+		return container.RockID
+	case GroundDirt:
+		return container.DirtID
+	}
+	return container.GrassID
+}
+
 func (container *ChunkTextureContainer) Bind() {
 	container.Dirt.Bind(container.DirtID)
 	container.Sand.Bind(container.SandID)
@@ -95,6 +153,7 @@ func (container *ChunkTextureContainer) Bind() {
 	container.Grass.Bind(container.GrassID)
 	container.Rock.Bind(container.RockID)
 	container.Water.Bind(container.WaterID)
+	container.Road.Bind(container.RoadID)
 }
 
 func (container *ChunkTextureContainer) Unbind() {
@@ -104,13 +163,14 @@ func (container *ChunkTextureContainer) Unbind() {
 	container.Grass.UnBind()
 	container.Rock.UnBind()
 	container.Water.UnBind()
+	container.Road.UnBind()
 }
 
 //relative coordinates
 func WorldToChunkCoordinates(hmap *HeightMap, world mgl32.Vec2) [2]int {
 	x := float64(world.X()) / float64(hmap.ChunkWorldSize)
 	y := float64(world.Y()) / float64(hmap.ChunkWorldSize)
-	return [2]int{int(math.Floor(x)), int(math.Floor(y))}
+	return hmap.WrapChunk([2]int{int(math.Floor(x)), int(math.Floor(y))})
 }
 
 func ChunkToWorldCoordinates(hmap *HeightMap, chunk [2]int) mgl32.Vec2 {
@@ -128,15 +188,20 @@ func GetVisibilityList(heightMap *HeightMap, worldPos mgl32.Vec2, radius int) []
 	chunks := []*Chunk{}
 	chunkPos := WorldToChunkCoordinates(heightMap, worldPos)
 
+	//on wrapping worlds a radius over half the world sees chunks twice, once is enough
+	seen := make(map[[2]int]bool)
 	rsquared := radius * radius //precompute
 	for x := -radius; x <= radius; x++ {
 		for y := -radius; y <= radius; y++ {
-			coord := [2]int{x + chunkPos[0], y + chunkPos[1]}
-			if x*x+y*y <= rsquared {
+			draw := [2]int{x + chunkPos[0], y + chunkPos[1]}
+			coord := heightMap.WrapChunk(draw)
+			if x*x+y*y <= rsquared && !seen[coord] {
+				seen[coord] = true
 				if heightMap.Chunks[coord] == nil {
 					chunk := Chunk{NBPoints: heightMap.ChunkNBPoints, WorldSize: heightMap.ChunkWorldSize, Position: coord, Loading: false, Loaded: false, AtomicNeedOpenGLLoading: 0}
 					heightMap.Chunks[coord] = &chunk
 				}
+				heightMap.Chunks[coord].DrawPosition = draw
 				chunks = append(chunks, heightMap.Chunks[coord])
 			}
 		}
@@ -147,9 +212,11 @@ func GetVisibilityList(heightMap *HeightMap, worldPos mgl32.Vec2, radius int) []
 
 func GetRenderList(heightMap *HeightMap, visList []*Chunk, camera cam.FpsCamera) []*Chunk {
 	renderList := []*Chunk{}
+	markSeen(visList)
+	frustum := camera.Frustum()
 	for _, chunk := range visList {
-		//TODO: some form of frustum culling
-		if chunk.Loaded {
+		if chunk.Loaded && frustum.ContainsBox(chunk.Bounds()) {
+			selectLOD(heightMap, chunk, camera.Position())
 			renderList = append(renderList, chunk)
 		}
 	}
@@ -168,11 +235,16 @@ func GetLoadList(heightMap *HeightMap, worldPos mgl32.Vec2, radius int) []*Chunk
 	return loadList
 }
 
-func ChunkLoadingWorker(chunks <-chan *Chunk, heightMap *HeightMap, textureContainer *ChunkTextureContainer) {
+func ChunkLoadingWorker(queue *LoadQueue, heightMap *HeightMap, textureContainer *ChunkTextureContainer) {
 	fmt.Println("Starting worker")
-	for chunk := range chunks {
-		LoadChunk(chunk, heightMap, textureContainer)
-		atomic.StoreInt32(&chunk.AtomicNeedOpenGLLoading, 1) //flag as loaded
+	for {
+		chunk := queue.next()
+		if chunk.Loaded {
+			RemeshChunk(chunk, heightMap, textureContainer)
+		} else {
+			LoadChunk(chunk, heightMap, textureContainer)
+		}
+		queue.finish(chunk)
 	}
 }
 
@@ -181,79 +253,194 @@ func LoadChunk(chunk *Chunk, heightMap *HeightMap, textureContainer *ChunkTextur
 	if chunk.Loaded {
 		return
 	}
+	if heightMap.Volume != nil {
+		loadVolumeChunk(chunk, heightMap, textureContainer)
+		return
+	}
+	//sculpted chunks are not cached, the edit layer is saved on its own
+	store := heightMap.Store
+	if heightMap.Edits.Has(chunk.Position) {
+		store = nil
+	}
+	cached := store != nil && store.Load(chunk)
+	if !cached {
+		GenerateChunk(chunk, heightMap)
+	}
+	if chunk.Cancelled() {
+		return
+	}
+	fillHeightRange(chunk)
+
+	//build mesh
+	mesh := CreateChunkPolyMesh(*chunk, textureContainer, heightMap)
+	//build model's vertex and connectivity arrays
+	if heightMap.LOD != nil {
+		chunk.LODModels = buildLODModels(mesh, chunk, heightMap.LOD)
+		chunk.Model = chunk.LODModels[0]
+	} else {
+		chunk.Model = new(gfx.Model)
+		chunk.Model.LoadingData = gfx.FillModelData(&mesh)
+	}
+
+	if !cached {
+		chunk.GrassTransforms = getGrassTransforms(chunk, heightMap.Seed)
+		chunk.TreesTransforms, chunk.TreesBiome = getTreesTransforms(chunk, heightMap.Seed, heightMap.Edits.ChunkPlants(chunk.Position))
+		clearRoadCorridor(chunk, heightMap)
+		if store != nil {
+			if err := store.Save(chunk); err != nil {
+				log.Println("chunk cache:", err)
+			}
+		}
+	}
+
+	if heightMap.Roads != nil {
+		if roads := CreateRoadMesh(chunk, textureContainer, heightMap); len(roads.Vertices) > 0 {
+			chunk.RoadModel = new(gfx.Model)
+			chunk.RoadModel.LoadingData = gfx.FillModelData(&roads)
+		}
+	}
+
+	//Chunk loaded. Only opengl loading left.
+}
+
+// GenerateChunk fills the height, water, lake and biome maps of a heightfield
+// chunk, without touching OpenGL or the vegetation.
+func GenerateChunk(chunk *Chunk, heightMap *HeightMap) {
 	//fill up heightmap
 	chunk.Map = make([]float64, (chunk.NBPoints+1)*(chunk.NBPoints+1))
 	chunk.WaterMap = make([]float64, (chunk.NBPoints+1)*(chunk.NBPoints+1))
+	chunk.LakeMap = make([]float64, (chunk.NBPoints+1)*(chunk.NBPoints+1))
 	chunk.NormalY = make([]float64, (chunk.NBPoints+1)*(chunk.NBPoints+1))
-	step := float64(chunk.WorldSize) / float64(chunk.NBPoints)
-	position := chunk.Position
-	//float conversions before loop
-	var posf = [2]float64{float64(position[0]), float64(position[1])}
-	var worldSizef = float64(chunk.WorldSize)
 
-	for x := 0; x < int(chunk.NBPoints)+1; x++ {
-		for z := 0; z < int(chunk.NBPoints)+1; z++ {
-			index := x + z*int(chunk.NBPoints+1)
-			posX := (posf[0])*worldSizef + float64(x)*step
-			posZ := (posf[1])*worldSizef + float64(z)*step
+	if heightMap.Erosion != nil || heightMap.Thermal != nil {
+		erodeChunk(chunk, heightMap)
+	} else {
+		splitPadded(chunk, sampleTerrain(heightMap, chunk.Position, chunk.NBPoints, chunk.WorldSize, 1))
+	}
+	//the load queue may have cancelled the chunk, stop between the passes
+	if chunk.Cancelled() {
+		return
+	}
 
-			chunk.Map[index] = heightMap.FinalTerrain.GetValue(float64(posX), 0, float64(posZ))
-			chunk.WaterMap[index] = heightMap.RiverScaleBias.GetValue(float64(posX), 0, float64(posZ))
+	if heightMap.Rivers != nil {
+		carveRivers(chunk, heightMap)
+		carveRim(chunk, heightMap)
+		if chunk.Cancelled() {
+			return
+		}
+	} else {
+		for i := range chunk.LakeMap {
+			chunk.LakeMap[i] = NoLake
 		}
 	}
+	if heightMap.Roads != nil {
+		applyRoads(chunk, heightMap)
+	}
+	applyEdits(chunk, heightMap)
 
-	//build mesh
-	mesh := CreateChunkPolyMesh(*chunk, textureContainer, heightMap)
-	//build model's vertex and connectivity arrays
-	chunk.Model = new(gfx.Model)
-	chunk.Model.LoadingData = gfx.FillModelData(&mesh)
+	fillBiomeMap(chunk, heightMap)
+}
 
-	chunk.GrassTransforms = getGrassTransforms(chunk)
-	chunk.TreesTransforms = getTreesTransforms(chunk)
+// sampleTerrain samples the terrain on the chunk grid grown by pad points on
+// every side. The result is (nbPoints+1+2*pad)^2 values, row major in z.
+func sampleTerrain(heightMap *HeightMap, position [2]int, nbPoints uint32, worldSize uint32, pad int) []float64 {
+	size := int(nbPoints) + 1 + 2*pad
+	field := make([]float64, size*size)
+	step := float64(worldSize) / float64(nbPoints)
+	//float conversions before loop
+	var posf = [2]float64{float64(position[0]), float64(position[1])}
+	var worldSizef = float64(worldSize)
 
-	//Chunk loaded. Only opengl loading left.
+	for x := 0; x < size; x++ {
+		for z := 0; z < size; z++ {
+			posX := (posf[0])*worldSizef + float64(x-pad)*step
+			posZ := (posf[1])*worldSizef + float64(z-pad)*step
+			field[x+z*size] = heightMap.Terrain.GetValue(posX, 0, posZ)
+		}
+	}
+	return field
 }
 
 // TODO: isHQ ? transform = transform.Mul4(mgl32.Scale3D(5, 5, 5)) : nil
-func getTreesTransforms(chunk *Chunk) []mgl32.Mat4 {
+func getTreesTransforms(chunk *Chunk, seed int64, plants map[int32]PlantEdit) ([]mgl32.Mat4, []BiomeID) {
 	var transforms []mgl32.Mat4
+	var biomes []BiomeID
 
+	rng := ChunkRand(seed, chunk.Position, "trees")
 	step := float32(chunk.WorldSize) / float32(chunk.NBPoints)
-	angle := float32(5.0 * math.Cos(glfw.GetTime()))
-	for x := 0; x < int(chunk.NBPoints)+1; x += int(chunk.NBPoints / 32) {
-		for z := 0; z < int(chunk.NBPoints)+1; z += int(chunk.NBPoints / 32) {
+	angle := float32(5.0 * math.Cos(2.0*math.Pi*rng.Float64()))
+	stride := int(chunk.NBPoints / 32)
+	addTree := func(x, z int) {
+		i := x + z*int(chunk.NBPoints+1)
+		posY := float32(chunk.Map[i])
+		posX := float32(chunk.Position[0])*float32(chunk.WorldSize) + float32(x)*step
+		posZ := float32(chunk.Position[1])*float32(chunk.WorldSize) + float32(z)*step
+		transform := mgl32.Translate3D(posX, -2*posY, posZ).Mul4(mgl32.Rotate3DY(posY * 360.0).Mat4())
+		transform = transform.Mul4(mgl32.Rotate3DX(mgl32.DegToRad(angle)).Mat4())
+
+		transforms = append(transforms, transform)
+		biomes = append(biomes, chunk.BiomeMap[i])
+	}
+	for x := 0; x < int(chunk.NBPoints)+1; x += stride {
+		for z := 0; z < int(chunk.NBPoints)+1; z += stride {
 			i := x + z*int(chunk.NBPoints+1)
-			posY := float32(chunk.Map[i])
-			if (posY < 0.0 || posY > 0.10 ) && chunk.WaterMap[i] < 2.0 || chunk.NormalY[i] > -0.9{
+			//always draw, so the sequence does not depend on the filters
+			chance := rng.Float32()
+			switch plants[int32(i)] {
+			case PlantRemoved:
+				continue
+			case PlantPlaced:
+				if !isWater(chunk, i) {
+					addTree(x, z)
+				}
 				continue
 			}
-			posX := float32(chunk.Position[0])*float32(chunk.WorldSize) + float32(x)*step
-			posZ := float32(chunk.Position[1])*float32(chunk.WorldSize) + float32(z)*step
-			transform := mgl32.Translate3D(posX, -2*posY, posZ).Mul4(mgl32.Rotate3DY(posY * 360.0).Mat4())
-			transform = transform.Mul4(mgl32.Rotate3DX(mgl32.DegToRad(angle)).Mat4())
+			if isWater(chunk, i) || chunk.NormalY[i] > -0.9 || chance >= Biomes[chunk.BiomeMap[i]].TreeDensity {
+				continue
+			}
+			addTree(x, z)
+		}
+	}
 
-			transforms = append(transforms, transform)
+	//trees planted between the generated ones, in point order
+	var placed []int
+	for index, edit := range plants {
+		x, z := int(index)%int(chunk.NBPoints+1), int(index)/int(chunk.NBPoints+1)
+		if edit == PlantPlaced && (x%stride != 0 || z%stride != 0) && !isWater(chunk, int(index)) {
+			placed = append(placed, int(index))
 		}
 	}
-	return transforms
+	sort.Ints(placed)
+	for _, index := range placed {
+		addTree(index%int(chunk.NBPoints+1), index/int(chunk.NBPoints+1))
+	}
+	return transforms, biomes
 }
 
-func getGrassTransforms(chunk *Chunk) []mgl32.Mat4 {
+func getGrassTransforms(chunk *Chunk, seed int64) []mgl32.Mat4 {
 	var transforms []mgl32.Mat4
 
+	rng := ChunkRand(seed, chunk.Position, "grass")
 	step := float32(chunk.WorldSize) / float32(chunk.NBPoints)
 	for x := 0; x < int(chunk.NBPoints)+1; x++ {
 		for z := 0; z < int(chunk.NBPoints)+1; z++ {
 			i := x + z*int(chunk.NBPoints+1)
 			posY := float32(chunk.Map[i])
-			if (posY < 0.20 || posY > 0.30 ) && chunk.WaterMap[i] < 2.0 || chunk.NormalY[i] > -0.9{
+			chance := rng.Float32()
+			angle := rng.Float32()
+			if isWater(chunk, i) || chunk.NormalY[i] > -0.9 || chance >= Biomes[chunk.BiomeMap[i]].GrassDensity {
 				continue
 			}
 			posX := float32(chunk.Position[0])*float32(chunk.WorldSize) + float32(x)*step
 			posZ := float32(chunk.Position[1])*float32(chunk.WorldSize) + float32(z)*step
-			transform := mgl32.Translate3D(posX, -2*posY, posZ).Mul4(mgl32.Rotate3DY(360.0 * rand.Float32()).Mat4())
+			transform := mgl32.Translate3D(posX, -2*posY, posZ).Mul4(mgl32.Rotate3DY(360.0 * angle).Mat4())
 			transforms = append(transforms, transform)
 		}
 	}
 	return transforms
 }
+
+// isWater tells if the vertex i is under the sea or a river.
+func isWater(chunk *Chunk, i int) bool {
+	return chunk.Map[i] < SeaLevel || chunk.WaterMap[i] > 0
+}
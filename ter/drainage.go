@@ -0,0 +1,440 @@
+package ter
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+)
+
+// RiverParams configures the drainage network. It is computed on a coarse
+// world aligned lattice, region by region, each region being solved with a
+// margin around it so flow coming from outside is accounted for. A lattice
+// point always belongs to the same region, so every chunk reads the same
+// values along shared edges.
+//
+// Regions do not pass flow to each other: only the catchment inside the
+// margin is counted, so a river coming from further away is narrower at the
+// seam than on the upstream side. The margin is wide enough for most rivers to
+// start inside it, widening it costs quadratically more noise samples.
+type RiverParams struct {
+	CellsPerChunk   int     //lattice cells along a chunk side
+	RegionChunks    int     //region side, in chunks
+	MarginChunks    int     //extra chunks solved around a region
+	MaxMarginChunks int     //margin grown to, for lakes spilling over it
+	CachedRegions   int     //solved regions kept in memory
+	SourceArea      float64 //lattice cells that must drain into a point for it to be a river
+	Depth           float64 //water depth of a river at its source, heightmap units
+	MaxDepth        float64
+	Carve           float64 //bed lowering, relative to the water depth
+	MinLakeDepth    float64 //shallower depressions stay dry
+}
+
+func DefaultRiverParams() *RiverParams {
+	return &RiverParams{
+		CellsPerChunk:   32,
+		RegionChunks:    8,
+		MarginChunks:    6,
+		MaxMarginChunks: 12,
+		CachedRegions:   16,
+		SourceArea:      400,
+		Depth:           0.04,
+		MaxDepth:        0.25,
+		Carve:           1.5,
+		MinLakeDepth:    0.01,
+	}
+}
+
+type drainageCache struct {
+	mutex   sync.Mutex
+	regions map[[2]int]*drainageRegion
+	clock   uint64
+}
+
+type drainageRegion struct {
+	done  chan struct{}
+	used  uint64    //cache clock of the last use
+	depth []float64 //water depth per lattice point of the region core
+	lake  []float64 //lake surface per lattice point, NoLake outside lakes
+}
+
+// NoLake marks points of Chunk.LakeMap that are not under a lake.
+var NoLake = math.Inf(-1)
+
+func newDrainageCache() *drainageCache {
+	return &drainageCache{regions: make(map[[2]int]*drainageRegion)}
+}
+
+// d8 neighbours with their distance
+var drainageNeighbours = [8][3]float64{
+	{-1, 0, 1}, {1, 0, 1}, {0, -1, 1}, {0, 1, 1},
+	{-1, -1, math.Sqrt2}, {1, -1, math.Sqrt2}, {-1, 1, math.Sqrt2}, {1, 1, math.Sqrt2},
+}
+
+func (heightMap *HeightMap) latticeSpacing() float64 {
+	return float64(heightMap.ChunkWorldSize) / float64(heightMap.Rivers.CellsPerChunk)
+}
+
+// drainageRegion returns the solved region, computing it on first use. Several
+// workers may ask for the same region, only one of them solves it.
+func (heightMap *HeightMap) drainageRegion(key [2]int) *drainageRegion {
+	cache := heightMap.drainage
+	cache.mutex.Lock()
+	region, ok := cache.regions[key]
+	if !ok {
+		region = &drainageRegion{done: make(chan struct{})}
+		cache.regions[key] = region
+		cache.evict(heightMap.Rivers.CachedRegions)
+	}
+	cache.clock++
+	region.used = cache.clock
+	cache.mutex.Unlock()
+
+	if ok {
+		<-region.done
+		return region
+	}
+	heightMap.solveDrainageRegion(key, region)
+	close(region.done)
+	return region
+}
+
+// evict forgets the least recently used solved regions over limit, they are
+// solved again if needed. Regions being solved are kept, workers wait on them.
+func (cache *drainageCache) evict(limit int) {
+	for limit > 0 && len(cache.regions) > limit {
+		var oldest [2]int
+		found := false
+		for key, region := range cache.regions {
+			select {
+			case <-region.done:
+			default:
+				continue
+			}
+			if !found || region.used < cache.regions[oldest].used {
+				oldest, found = key, true
+			}
+		}
+		if !found {
+			return
+		}
+		delete(cache.regions, oldest)
+	}
+}
+
+func (heightMap *HeightMap) solveDrainageRegion(key [2]int, region *drainageRegion) {
+	params := heightMap.Rivers
+	core := params.RegionChunks * params.CellsPerChunk
+	spacing := heightMap.latticeSpacing()
+
+	//the border of the solved area is an outlet, a lake spilling over it is
+	//cut: the area grows until every lake of the core spills inside it
+	var heights, level, routing []float64
+	var size, margin int
+	for marginChunks := params.MarginChunks; ; marginChunks = maxInt(1, 2*marginChunks) {
+		marginChunks = minInt(marginChunks, maxInt(params.MaxMarginChunks, params.MarginChunks))
+		margin = marginChunks * params.CellsPerChunk
+		size = core + 2*margin
+		originX := key[0]*core - margin
+		originZ := key[1]*core - margin
+		heights = make([]float64, size*size)
+		for x := 0; x < size; x++ {
+			for z := 0; z < size; z++ {
+				heights[x+z*size] = heightMap.Terrain.GetValue(float64(originX+x)*spacing, 0, float64(originZ+z)*spacing)
+			}
+		}
+
+		var spill []int
+		level, routing, spill = fillDepressions(heights, size)
+		if marginChunks >= params.MaxMarginChunks || !cutLake(heights, level, spill, size, margin, params.MinLakeDepth) {
+			break
+		}
+	}
+
+	//rivers flow over the filled surface, through lakes to their spill point
+	accumulation := flowAccumulation(routing, size)
+
+	region.depth = make([]float64, core*core)
+	region.lake = make([]float64, core*core)
+	for x := 0; x < core; x++ {
+		for z := 0; z < core; z++ {
+			i := (x + margin) + (z+margin)*size
+			region.lake[x+z*core] = NoLake
+			if heights[i] >= SeaLevel && level[i]-heights[i] > params.MinLakeDepth {
+				region.lake[x+z*core] = level[i]
+			}
+			if heights[i] < SeaLevel || accumulation[i] < params.SourceArea {
+				continue
+			}
+			depth := params.Depth * math.Sqrt(accumulation[i]/params.SourceArea)
+			region.depth[x+z*core] = math.Min(depth, params.MaxDepth)
+		}
+	}
+}
+
+// cutLake tells if a lake of the core spills over the border of the solved
+// area, its level then depends on terrain that was not sampled.
+func cutLake(heights, level []float64, spill []int, size, margin int, minDepth float64) bool {
+	for x := margin; x < size-margin; x++ {
+		for z := margin; z < size-margin; z++ {
+			i := x + z*size
+			if heights[i] < SeaLevel || level[i]-heights[i] <= minDepth {
+				continue
+			}
+			sx, sz := spill[i]%size, spill[i]/size
+			if sx == 0 || sz == 0 || sx == size-1 || sz == size-1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fillDepressions is a priority-flood: starting from the outlets, the sea and
+// the border of the solved area, cells are flooded lowest first, so every
+// closed basin is raised to the level of its spill point. It returns the flat
+// water level of every cell, the same surface with a tiny slope towards the
+// spill point, used to route the flow across lakes and flats, and for every
+// cell the one whose ground sets its level, its spill point under a lake.
+func fillDepressions(heights []float64, size int) ([]float64, []float64, []int) {
+	const epsilon = 1e-6
+	level := make([]float64, len(heights))
+	routing := make([]float64, len(heights))
+	spill := make([]int, len(heights))
+	closed := make([]bool, len(heights))
+	open := &floodQueue{}
+
+	for i, height := range heights {
+		x, z := i%size, i/size
+		if x == 0 || z == 0 || x == size-1 || z == size-1 || height < SeaLevel {
+			level[i] = height
+			routing[i] = height
+			spill[i] = i
+			closed[i] = true
+			heap.Push(open, floodCell{height, i})
+		}
+	}
+
+	for open.Len() > 0 {
+		cell := heap.Pop(open).(floodCell)
+		x, z := cell.index%size, cell.index/size
+		for _, neighbour := range drainageNeighbours {
+			nx, nz := x+int(neighbour[0]), z+int(neighbour[1])
+			if nx < 0 || nz < 0 || nx >= size || nz >= size {
+				continue
+			}
+			n := nx + nz*size
+			if closed[n] {
+				continue
+			}
+			closed[n] = true
+			level[n] = math.Max(heights[n], level[cell.index])
+			spill[n] = n
+			if heights[n] < level[cell.index] {
+				spill[n] = spill[cell.index]
+			}
+			routing[n] = math.Max(heights[n], routing[cell.index]+epsilon)
+			heap.Push(open, floodCell{routing[n], n})
+		}
+	}
+	return level, routing, spill
+}
+
+type floodCell struct {
+	height float64
+	index  int
+}
+
+type floodQueue []floodCell
+
+func (q floodQueue) Len() int { return len(q) }
+func (q floodQueue) Less(a, b int) bool {
+	if q[a].height == q[b].height {
+		return q[a].index < q[b].index
+	}
+	return q[a].height < q[b].height
+}
+func (q floodQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *floodQueue) Push(x interface{}) { *q = append(*q, x.(floodCell)) }
+func (q *floodQueue) Pop() interface{} {
+	old := *q
+	cell := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return cell
+}
+
+// flowAccumulation routes every cell to its steepest lower neighbour (D8) and
+// returns how many cells drain through each one. Cells without a lower
+// neighbour are sinks, the sea swallows everything that reaches it.
+func flowAccumulation(heights []float64, size int) []float64 {
+	order := make([]int, len(heights))
+	for i := range order {
+		order[i] = i
+	}
+	//highest first, so a cell is complete when it is visited
+	sort.Slice(order, func(a, b int) bool {
+		return heights[order[a]] > heights[order[b]]
+	})
+
+	accumulation := make([]float64, len(heights))
+	for i := range accumulation {
+		accumulation[i] = 1
+	}
+	for _, i := range order {
+		if heights[i] < SeaLevel {
+			continue
+		}
+		x, z := i%size, i/size
+		target := -1
+		steepest := 0.0
+		for _, neighbour := range drainageNeighbours {
+			nx, nz := x+int(neighbour[0]), z+int(neighbour[1])
+			if nx < 0 || nz < 0 || nx >= size || nz >= size {
+				continue
+			}
+			n := nx + nz*size
+			slope := (heights[i] - heights[n]) / neighbour[2]
+			if slope > steepest {
+				steepest = slope
+				target = n
+			}
+		}
+		if target >= 0 {
+			accumulation[target] += accumulation[i]
+		}
+	}
+	return accumulation
+}
+
+// latticePatch gathers the river depth and lake surface of the lattice points
+// covering a chunk, (CellsPerChunk+1)^2 values each.
+func (heightMap *HeightMap) latticePatch(position [2]int) ([]float64, []float64) {
+	params := heightMap.Rivers
+	cells := params.CellsPerChunk
+	core := params.RegionChunks * cells
+	patch := make([]float64, (cells+1)*(cells+1))
+	lakes := make([]float64, (cells+1)*(cells+1))
+
+	var region *drainageRegion
+	var regionKey [2]int
+	for x := 0; x <= cells; x++ {
+		for z := 0; z <= cells; z++ {
+			lx := position[0]*cells + x
+			lz := position[1]*cells + z
+			//the last points of the last chunk of a wrapping world are the first ones
+			wrapped := heightMap.WrapChunk([2]int{floorDiv(lx, cells), floorDiv(lz, cells)})
+			lx += (wrapped[0] - floorDiv(lx, cells)) * cells
+			lz += (wrapped[1] - floorDiv(lz, cells)) * cells
+			key := [2]int{floorDiv(lx, core), floorDiv(lz, core)}
+			if region == nil || key != regionKey {
+				region = heightMap.drainageRegion(key)
+				regionKey = key
+			}
+			index := (lx - key[0]*core) + (lz-key[1]*core)*core
+			patch[x+z*(cells+1)] = region.depth[index]
+			lakes[x+z*(cells+1)] = region.lake[index]
+		}
+	}
+	return patch, lakes
+}
+
+// latticeWater tells if a lattice point is under a river or a lake.
+func (heightMap *HeightMap) latticeWater(lx, lz int) bool {
+	cells := heightMap.Rivers.CellsPerChunk
+	core := heightMap.Rivers.RegionChunks * cells
+	wrapped := heightMap.WrapChunk([2]int{floorDiv(lx, cells), floorDiv(lz, cells)})
+	lx += (wrapped[0] - floorDiv(lx, cells)) * cells
+	lz += (wrapped[1] - floorDiv(lz, cells)) * cells
+	key := [2]int{floorDiv(lx, core), floorDiv(lz, core)}
+	region := heightMap.drainageRegion(key)
+	index := (lx - key[0]*core) + (lz-key[1]*core)*core
+	return region.depth[index] > 0 || region.lake[index] != NoLake
+}
+
+// carveRivers fills chunk.WaterMap with the river and lake depth, lowers
+// chunk.Map under the rivers and records the lake surfaces in chunk.LakeMap.
+func carveRivers(chunk *Chunk, heightMap *HeightMap) {
+	params := heightMap.Rivers
+	cells := params.CellsPerChunk
+	patch, lakes := heightMap.latticePatch(chunk.Position)
+
+	points := int(chunk.NBPoints) + 1
+	for x := 0; x < points; x++ {
+		for z := 0; z < points; z++ {
+			i := x + z*points
+			depth := riverDepth(patch, cells, int(chunk.NBPoints), x, z)
+			if depth > 0 {
+				chunk.WaterMap[i] = depth
+				chunk.Map[i] -= depth * params.Carve
+			}
+
+			//a lake is flat, the finer terrain decides where the shore is
+			surface := lakeSurface(lakes, cells, x, z, int(chunk.NBPoints))
+			chunk.LakeMap[i] = NoLake
+			if surface > chunk.Map[i] {
+				chunk.LakeMap[i] = surface
+				chunk.WaterMap[i] = math.Max(chunk.WaterMap[i], surface-chunk.Map[i])
+			}
+		}
+	}
+}
+
+// carveRim carves the rivers into chunk.Rim, each point as the neighbour
+// owning it does.
+func carveRim(chunk *Chunk, heightMap *HeightMap) {
+	if chunk.Rim == nil {
+		return
+	}
+	points := int(chunk.NBPoints)
+	patches := make(map[[2]int][]float64)
+	for k := 0; k <= points; k++ {
+		for _, point := range [4][2]int{{k, -1}, {k, points + 1}, {-1, k}, {points + 1, k}} {
+			//the neighbour owning the point, and the point in it
+			var offset [2]int
+			for axis, p := range point {
+				if p < 0 {
+					offset[axis] = -1
+				} else if p > points {
+					offset[axis] = 1
+				}
+			}
+			patch := patches[offset]
+			if patch == nil {
+				patch, _ = heightMap.latticePatch([2]int{chunk.Position[0] + offset[0], chunk.Position[1] + offset[1]})
+				patches[offset] = patch
+			}
+			depth := riverDepth(patch, heightMap.Rivers.CellsPerChunk, points, point[0]-offset[0]*points, point[1]-offset[1]*points)
+			chunk.Rim[rimIndex(points, point[0], point[1])] -= depth * heightMap.Rivers.Carve
+		}
+	}
+}
+
+// riverDepth interpolates the river depth of a lattice patch at the point
+// (x, z) of a chunk with points cells a side.
+func riverDepth(patch []float64, cells, points, x, z int) float64 {
+	scale := float64(cells) / float64(points)
+	lx, lz := float64(x)*scale, float64(z)*scale
+	cx, cz := minInt(int(lx), cells-1), minInt(int(lz), cells-1)
+	return math.Max(0, bilinear(patch, cells+1, cx, cz, lx-float64(cx), lz-float64(cz)))
+}
+
+// lakeSurface is the highest lake around the vertex (x, z) of a chunk with
+// points cells a side: the lattice point under it if there is one, else the
+// two or four around it. It only depends on lattice points, so chunks agree
+// along their shared edges.
+func lakeSurface(lakes []float64, cells, x, z, points int) float64 {
+	x0, z0 := x*cells/points, z*cells/points
+	x1, z1 := x0, z0
+	if x*cells%points != 0 {
+		x1++
+	}
+	if z*cells%points != 0 {
+		z1++
+	}
+	return math.Max(math.Max(lakes[x0+z0*(cells+1)], lakes[x1+z0*(cells+1)]),
+		math.Max(lakes[x0+z1*(cells+1)], lakes[x1+z1*(cells+1)]))
+}
+
+func floorDiv(a, b int) int {
+	return int(math.Floor(float64(a) / float64(b)))
+}
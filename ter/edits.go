@@ -0,0 +1,283 @@
+package ter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EditLayer holds the sculpted height deltas, a sparse set of tiles on the
+// chunk grids. Generation adds them on top of the procedural terrain, so
+// they survive chunks being regenerated. Points on chunk edges are stored in
+// every chunk sharing them. Tiles are keyed by wrapped chunk position, like
+// Plants, the trees planted or removed by hand per point of a chunk grid.
+type EditLayer struct {
+	NBPoints uint32
+	Tiles    map[[2]int][]float64
+	Plants   map[[2]int]map[int32]PlantEdit
+
+	mutex  sync.Mutex
+	stroke *Stroke //recording, see BeginStroke
+}
+
+func NewEditLayer(nbPoints uint32) *EditLayer {
+	return &EditLayer{NBPoints: nbPoints, Tiles: make(map[[2]int][]float64), Plants: make(map[[2]int]map[int32]PlantEdit)}
+}
+
+// PlantEdit is what was done by hand to the tree of a point.
+type PlantEdit int8
+
+const (
+	PlantGenerated PlantEdit = iota //no edit, the generator decides
+	PlantPlaced
+	PlantRemoved
+)
+
+// Has tells if a chunk has been sculpted or had trees edited. A nil layer has
+// no edits.
+func (edits *EditLayer) Has(position [2]int) bool {
+	if edits == nil {
+		return false
+	}
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	return edits.Tiles[position] != nil || len(edits.Plants[position]) > 0
+}
+
+// ChunkPlants returns a copy of the tree edits of a chunk, nil when it has
+// none.
+func (edits *EditLayer) ChunkPlants(position [2]int) map[int32]PlantEdit {
+	if edits == nil {
+		return nil
+	}
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	if len(edits.Plants[position]) == 0 {
+		return nil
+	}
+	plants := make(map[int32]PlantEdit)
+	for index, edit := range edits.Plants[position] {
+		plants[index] = edit
+	}
+	return plants
+}
+
+// setPlant records the tree edit of a point and returns the previous one.
+func (edits *EditLayer) setPlant(position [2]int, index int32, edit PlantEdit) PlantEdit {
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	plants := edits.Plants[position]
+	before := plants[index]
+	if edit == PlantGenerated {
+		delete(plants, index)
+		if len(plants) == 0 {
+			delete(edits.Plants, position)
+		}
+		return before
+	}
+	if plants == nil {
+		plants = make(map[int32]PlantEdit)
+		edits.Plants[position] = plants
+	}
+	plants[index] = edit
+	return before
+}
+
+// Tile returns a copy of the deltas of a chunk, nil when it has none.
+func (edits *EditLayer) Tile(position [2]int) []float64 {
+	if edits == nil {
+		return nil
+	}
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	if edits.Tiles[position] == nil {
+		return nil
+	}
+	return append([]float64(nil), edits.Tiles[position]...)
+}
+
+// deltaAt interpolates the deltas at a position of the global grid, read from
+// the tile of the chunk owning each point. A nil layer has no edits.
+func (edits *EditLayer) deltaAt(heightMap *HeightMap, gridX, gridZ float64) float64 {
+	if edits == nil {
+		return 0
+	}
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	points := int(edits.NBPoints)
+	point := func(x, z int) float64 {
+		position := [2]int{floorDiv(x, points), floorDiv(z, points)}
+		tile := edits.Tiles[heightMap.WrapChunk(position)]
+		if tile == nil {
+			return 0
+		}
+		return tile[x-position[0]*points+(z-position[1]*points)*(points+1)]
+	}
+	x, z := int(math.Floor(gridX)), int(math.Floor(gridZ))
+	fx, fz := gridX-float64(x), gridZ-float64(z)
+	top := point(x, z) + (point(x+1, z)-point(x, z))*fx
+	bottom := point(x, z+1) + (point(x+1, z+1)-point(x, z+1))*fx
+	return top + (bottom-top)*fz
+}
+
+// add moves the global grid point (gridX, gridZ) by delta in every chunk
+// sharing it, and records these chunks in touched. The caller holds the lock.
+func (edits *EditLayer) add(heightMap *HeightMap, gridX, gridZ int, delta float64, touched map[[2]int]bool) {
+	points := int(edits.NBPoints)
+	for _, dx := range [2]int{0, -1} {
+		for _, dz := range [2]int{0, -1} {
+			position := [2]int{floorDiv(gridX, points) + dx, floorDiv(gridZ, points) + dz}
+			localX := gridX - position[0]*points
+			localZ := gridZ - position[1]*points
+			if localX > points || localZ > points {
+				continue
+			}
+			position = heightMap.WrapChunk(position)
+			tile := edits.Tiles[position]
+			if tile == nil {
+				tile = make([]float64, (points+1)*(points+1))
+				edits.Tiles[position] = tile
+			}
+			tile[localX+localZ*(points+1)] += delta
+			if edits.stroke != nil {
+				edits.stroke.record(position, localX+localZ*(points+1), delta)
+			}
+			touched[position] = true
+		}
+	}
+}
+
+// applyEdits adds the deltas of the chunk to its freshly generated Map.
+func applyEdits(chunk *Chunk, heightMap *HeightMap) {
+	chunk.Edits = heightMap.Edits.Tile(chunk.Position)
+	for i, delta := range chunk.Edits {
+		chunk.Map[i] += delta
+	}
+}
+
+var editFileMagic = [4]byte{'P', 'G', 'E', 'D'}
+
+const editFileVersion = 2 //version 1 files have no trees
+
+// Save writes the layer as gzip: a header, then the position and float32
+// deltas of every tile, then the position and point edits of every chunk
+// with edited trees.
+func (edits *EditLayer) Save(file string) error {
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+
+	if dir := filepath.Dir(file); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	out, err := ioutil.TempFile(filepath.Dir(file), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	buffered := bufio.NewWriter(out)
+	writer := gzip.NewWriter(buffered)
+	binary.Write(writer, binary.LittleEndian, editFileMagic)
+	binary.Write(writer, binary.LittleEndian, [3]uint32{editFileVersion, edits.NBPoints, uint32(len(edits.Tiles))})
+	for position, tile := range edits.Tiles {
+		binary.Write(writer, binary.LittleEndian, [2]int32{int32(position[0]), int32(position[1])})
+		writeFloats(writer, tile)
+	}
+	binary.Write(writer, binary.LittleEndian, uint32(len(edits.Plants)))
+	for position, plants := range edits.Plants {
+		binary.Write(writer, binary.LittleEndian, [3]int32{int32(position[0]), int32(position[1]), int32(len(plants))})
+		for index, edit := range plants {
+			binary.Write(writer, binary.LittleEndian, [2]int32{index, int32(edit)})
+		}
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), file)
+}
+
+// LoadEditLayer reads a layer written by Save. Its chunks must have as many
+// points as the terrain.
+func LoadEditLayer(file string, nbPoints uint32) (*EditLayer, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	reader, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return nil, fmt.Errorf("edits %s: %v", file, err)
+	}
+
+	var magic [4]byte
+	var header [3]uint32
+	if err := binary.Read(reader, binary.LittleEndian, &magic); err != nil {
+		return nil, fmt.Errorf("edits %s: %v", file, err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("edits %s: %v", file, err)
+	}
+	if magic != editFileMagic || header[0] < 1 || header[0] > editFileVersion {
+		return nil, fmt.Errorf("edits %s: not an edit file", file)
+	}
+	if header[1] != nbPoints {
+		return nil, fmt.Errorf("edits %s: made for %d points per chunk, not %d", file, header[1], nbPoints)
+	}
+
+	edits := NewEditLayer(nbPoints)
+	points := int(nbPoints+1) * int(nbPoints+1)
+	for i := uint32(0); i < header[2]; i++ {
+		var position [2]int32
+		if err := binary.Read(reader, binary.LittleEndian, &position); err != nil {
+			return nil, fmt.Errorf("edits %s: %v", file, err)
+		}
+		tile, err := readFloats(reader, points)
+		if err != nil {
+			return nil, fmt.Errorf("edits %s: %v", file, err)
+		}
+		edits.Tiles[[2]int{int(position[0]), int(position[1])}] = tile
+	}
+	if header[0] < 2 {
+		return edits, nil
+	}
+
+	var chunks uint32
+	if err := binary.Read(reader, binary.LittleEndian, &chunks); err != nil {
+		return nil, fmt.Errorf("edits %s: %v", file, err)
+	}
+	for i := uint32(0); i < chunks; i++ {
+		var chunk [3]int32
+		if err := binary.Read(reader, binary.LittleEndian, &chunk); err != nil {
+			return nil, fmt.Errorf("edits %s: %v", file, err)
+		}
+		if chunk[2] < 0 || int(chunk[2]) > points {
+			return nil, fmt.Errorf("edits %s: %d tree edits in a chunk of %d points", file, chunk[2], points)
+		}
+		plants := make(map[int32]PlantEdit)
+		for j := int32(0); j < chunk[2]; j++ {
+			var plant [2]int32
+			if err := binary.Read(reader, binary.LittleEndian, &plant); err != nil {
+				return nil, fmt.Errorf("edits %s: %v", file, err)
+			}
+			plants[plant[0]] = PlantEdit(plant[1])
+		}
+		edits.Plants[[2]int{int(chunk[0]), int(chunk[1])}] = plants
+	}
+	return edits, nil
+}
@@ -0,0 +1,207 @@
+package ter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/worldsproject/noiselib"
+)
+
+// Elevation is a terrain source backed by a real world elevation grid (DEM).
+// It is a noiselib module, so it plugs into a NoiseGraph and LoadChunk
+// samples it exactly like the procedural terrain.
+type Elevation struct {
+	Width   int
+	Depth   int
+	Heights []float64 //file units, row major in z
+
+	CellSize float64 //world units between two samples
+	OriginX  float64 //world position of the first sample
+	OriginZ  float64
+	Scale    float64 //heightmap units per file unit
+	Bias     float64
+
+	//optional procedural detail added on top
+	Detail      noiselib.Module
+	DetailScale float64
+}
+
+// srtm voids, see fillVoids
+const hgtVoid = -32768
+
+// LoadElevation reads a DEM, the format comes from the extension: .hgt SRTM
+// tiles (big endian int16 meters), 16-bit grayscale .png and little endian
+// uint16 .r16/.raw grids (both read as 0..1), and little endian float32
+// .r32/.f32 grids. Grids are square unless width is given.
+func LoadElevation(file string, width int) (*Elevation, error) {
+	var heights []float64
+	var err error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".hgt":
+		heights, err = readHGT(file)
+	case ".png":
+		heights, width, err = readPNG16(file)
+	case ".r16", ".raw":
+		heights, err = readRaw(file, 2)
+	case ".r32", ".f32":
+		heights, err = readRaw(file, 4)
+	default:
+		return nil, fmt.Errorf("elevation %s: unknown format", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if width <= 0 {
+		width = int(math.Sqrt(float64(len(heights))))
+	}
+	if width <= 1 || len(heights)%width != 0 || len(heights)/width <= 1 {
+		return nil, fmt.Errorf("elevation %s: %d samples do not make a grid of width %d", file, len(heights), width)
+	}
+	return &Elevation{
+		Width:    width,
+		Depth:    len(heights) / width,
+		Heights:  heights,
+		CellSize: 1.0,
+		Scale:    1.0,
+	}, nil
+}
+
+func readHGT(file string) ([]float64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	heights := make([]float64, len(data)/2)
+	voids := make([]bool, len(heights))
+	for i := range heights {
+		value := int16(binary.BigEndian.Uint16(data[2*i:]))
+		if value == hgtVoid {
+			voids[i] = true
+		} else {
+			heights[i] = float64(value)
+		}
+	}
+	fillVoids(heights, voids, int(math.Sqrt(float64(len(heights)))))
+	return heights, nil
+}
+
+// fillVoids interpolates every void from the nearest valid samples along its
+// row, column and diagonals, weighted by inverse distance. A void with none of them
+// stays 0.
+func fillVoids(heights []float64, voids []bool, width int) {
+	if width <= 0 {
+		return
+	}
+	depth := len(heights) / width
+	filled := make([]float64, len(heights))
+	for i, void := range voids {
+		if !void {
+			continue
+		}
+		x, z := i%width, i/width
+		sum, weights := 0.0, 0.0
+		for _, direction := range [8][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}, {1, 1}, {1, -1}, {-1, 1}, {-1, -1}} {
+			for step := 1; ; step++ {
+				nx, nz := x+direction[0]*step, z+direction[1]*step
+				if nx < 0 || nz < 0 || nx >= width || nz >= depth {
+					break
+				}
+				if j := nx + nz*width; !voids[j] {
+					weight := 1 / math.Hypot(float64(nx-x), float64(nz-z))
+					sum += heights[j] * weight
+					weights += weight
+					break
+				}
+			}
+		}
+		if weights > 0 {
+			filled[i] = sum / weights
+		}
+	}
+	//written after the scan so filled voids do not feed their neighbours
+	for i, void := range voids {
+		if void {
+			heights[i] = filled[i]
+		}
+	}
+}
+
+func readPNG16(file string) ([]float64, int, error) {
+	imgFile, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer imgFile.Close()
+
+	img, _, err := image.Decode(imgFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	heights := make([]float64, width*bounds.Dy())
+	for z := bounds.Min.Y; z < bounds.Max.Y; z++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.Gray16Model.Convert(img.At(x, z)).(color.Gray16)
+			heights[(x-bounds.Min.X)+(z-bounds.Min.Y)*width] = float64(gray.Y) / 65535.0
+		}
+	}
+	return heights, width, nil
+}
+
+func readRaw(file string, sampleSize int) ([]float64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	heights := make([]float64, len(data)/sampleSize)
+	for i := range heights {
+		if sampleSize == 2 {
+			heights[i] = float64(binary.LittleEndian.Uint16(data[2*i:])) / 65535.0
+		} else {
+			heights[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+	}
+	return heights, nil
+}
+
+// GetValue bilinearly interpolates the grid, clamped at its border. y is only
+// forwarded to the detail module.
+func (elevation *Elevation) GetValue(x, y, z float64) float64 {
+	gridX := math.Max(0, math.Min((x-elevation.OriginX)/elevation.CellSize, float64(elevation.Width-1)))
+	gridZ := math.Max(0, math.Min((z-elevation.OriginZ)/elevation.CellSize, float64(elevation.Depth-1)))
+	cellX := minInt(int(gridX), elevation.Width-2)
+	cellZ := minInt(int(gridZ), elevation.Depth-2)
+
+	i := cellX + cellZ*elevation.Width
+	fx, fz := gridX-float64(cellX), gridZ-float64(cellZ)
+	h := elevation.Heights
+	height := h[i]*(1-fx)*(1-fz) + h[i+1]*fx*(1-fz) + h[i+elevation.Width]*(1-fx)*fz + h[i+elevation.Width+1]*fx*fz
+
+	value := height*elevation.Scale + elevation.Bias
+	if elevation.Detail != nil {
+		value += elevation.DetailScale * elevation.Detail.GetValue(x, y, z)
+	}
+	return value
+}
+
+func (elevation *Elevation) GetSourceModule(index int) noiselib.Module {
+	return elevation.Detail
+}
+
+func (elevation *Elevation) SetSourceModule(index int, sourceModule noiselib.Module) {
+	elevation.Detail = sourceModule
+}
+
+func (elevation *Elevation) SourceModuleCount() int {
+	return 1
+}
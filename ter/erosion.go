@@ -0,0 +1,323 @@
+package ter
+
+import (
+	"math"
+	"sync"
+)
+
+// ErosionParams configures the droplet based hydraulic erosion applied to
+// every chunk after sampling.
+type ErosionParams struct {
+	DropletsPerCell float64 //droplets started per world cell
+	Lifetime        int     //max steps of a droplet
+	Inertia         float64 //how much a droplet keeps its direction, 0..1
+	Capacity        float64 //sediment capacity factor
+	MinCapacity     float64
+	Deposition      float64 //fraction of surplus sediment dropped per step
+	Erosion         float64 //fraction of free capacity eroded per step
+	Evaporation     float64 //fraction of water lost per step
+	Gravity         float64
+
+	//cells sampled around the chunk so droplets can flow in from neighbours
+	Padding int
+	//cells on each side of a chunk edge over which the eroded fields of the
+	//two chunks are blended, so both compute the same edge vertices. Kept well
+	//inside Padding, where droplets from outside are missing.
+	Overlap int
+	//eroded fields kept for the neighbouring chunks
+	CachedTiles int
+}
+
+func DefaultErosionParams() *ErosionParams {
+	return &ErosionParams{
+		DropletsPerCell: 6.5,
+		Lifetime:        30,
+		Inertia:         0.05,
+		Capacity:        4.0,
+		MinCapacity:     0.001,
+		Deposition:      0.3,
+		Erosion:         0.3,
+		Evaporation:     0.02,
+		Gravity:         4.0,
+		Padding:         32,
+		Overlap:         8,
+		CachedTiles:     64,
+	}
+}
+
+// HydraulicErosion runs droplets over a size*size heightfield in place, its
+// first point being the world cell (originX, originZ). Every world cell starts
+// the same droplets whatever the field, so overlapping fields erode alike.
+// Heights grow upwards, distances are in cells.
+func HydraulicErosion(field []float64, size int, originX, originZ int, seed int64, params *ErosionParams) {
+	//row major over world cells, the order is the same in every field
+	for z := 0; z < size-1; z++ {
+		for x := 0; x < size-1; x++ {
+			cell := mix64(uint64(seed) ^ mix64(uint64(originX+x)) ^ mix64(mix64(uint64(originZ+z))))
+			count := int(params.DropletsPerCell)
+			if unitFloat(cell) < params.DropletsPerCell-float64(count) {
+				count++
+			}
+			for k := 1; k <= count; k++ {
+				h := mix64(cell + uint64(k))
+				runDroplet(field, size, float64(x)+unitFloat(h), float64(z)+unitFloat(mix64(h)), params)
+			}
+		}
+	}
+}
+
+// unitFloat maps a hash to [0, 1).
+func unitFloat(h uint64) float64 {
+	return float64(h>>11) / (1 << 53)
+}
+
+func runDroplet(field []float64, size int, posX, posZ float64, params *ErosionParams) {
+	dirX, dirZ := 0.0, 0.0
+	speed := 1.0
+	water := 1.0
+	sediment := 0.0
+
+	for step := 0; step < params.Lifetime; step++ {
+		cellX := int(posX)
+		cellZ := int(posZ)
+		offX := posX - float64(cellX)
+		offZ := posZ - float64(cellZ)
+
+		height, gradX, gradZ := sampleGradient(field, size, posX, posZ)
+
+		//downhill, with inertia
+		dirX = dirX*params.Inertia - gradX*(1-params.Inertia)
+		dirZ = dirZ*params.Inertia - gradZ*(1-params.Inertia)
+		length := math.Sqrt(dirX*dirX + dirZ*dirZ)
+		if length == 0 {
+			break
+		}
+		dirX /= length
+		dirZ /= length
+		posX += dirX
+		posZ += dirZ
+		if posX < 0 || posZ < 0 || posX >= float64(size-1) || posZ >= float64(size-1) {
+			break
+		}
+
+		newHeight, _, _ := sampleGradient(field, size, posX, posZ)
+		deltaHeight := newHeight - height
+
+		capacity := math.Max(-deltaHeight*speed*water*params.Capacity, params.MinCapacity)
+		if sediment > capacity || deltaHeight > 0 {
+			//uphill: fill the pit behind us, otherwise drop the surplus
+			var amount float64
+			if deltaHeight > 0 {
+				amount = math.Min(deltaHeight, sediment)
+			} else {
+				amount = (sediment - capacity) * params.Deposition
+			}
+			sediment -= amount
+			depositBilinear(field, size, cellX, cellZ, offX, offZ, amount)
+		} else {
+			//never dig deeper than the height difference
+			amount := math.Min((capacity-sediment)*params.Erosion, -deltaHeight)
+			sediment += amount
+			depositBilinear(field, size, cellX, cellZ, offX, offZ, -amount)
+		}
+
+		speed = math.Sqrt(math.Max(0, speed*speed-deltaHeight*params.Gravity))
+		water *= 1 - params.Evaporation
+	}
+}
+
+func sampleGradient(field []float64, size int, posX, posZ float64) (float64, float64, float64) {
+	cellX := int(posX)
+	cellZ := int(posZ)
+	x := posX - float64(cellX)
+	z := posZ - float64(cellZ)
+
+	i := cellX + cellZ*size
+	h00 := field[i]
+	h10 := field[i+1]
+	h01 := field[i+size]
+	h11 := field[i+size+1]
+
+	gradX := (h10-h00)*(1-z) + (h11-h01)*z
+	gradZ := (h01-h00)*(1-x) + (h11-h10)*x
+	height := h00*(1-x)*(1-z) + h10*x*(1-z) + h01*(1-x)*z + h11*x*z
+	return height, gradX, gradZ
+}
+
+func depositBilinear(field []float64, size int, cellX, cellZ int, x, z float64, amount float64) {
+	i := cellX + cellZ*size
+	field[i] += amount * (1 - x) * (1 - z)
+	field[i+1] += amount * x * (1 - z)
+	field[i+size] += amount * (1 - x) * z
+	field[i+size+1] += amount * x * z
+}
+
+// erosionMargins returns the padding and blending overlap needed by the
+// enabled erosion passes.
+func (heightMap *HeightMap) erosionMargins() (int, int) {
+	pad, overlap := 0, 0
+	if heightMap.Erosion != nil {
+		pad = heightMap.Erosion.Padding
+		overlap = heightMap.Erosion.Overlap
+	}
+	if heightMap.Thermal != nil {
+		pad = maxInt(pad, heightMap.Thermal.Padding)
+		overlap = maxInt(overlap, heightMap.Thermal.Overlap)
+	}
+	return pad, overlap
+}
+
+type erosionCache struct {
+	mutex sync.Mutex
+	tiles map[[2]int]*erosionTile
+	clock uint64
+}
+
+// erosionTile is the padded field of a chunk after the erosion passes.
+type erosionTile struct {
+	done  chan struct{}
+	used  uint64 //cache clock of the last use
+	field []float64
+}
+
+func newErosionCache() *erosionCache {
+	return &erosionCache{tiles: make(map[[2]int]*erosionTile)}
+}
+
+// erodedTile returns the eroded field of the chunk at position, computing it
+// on first use like drainageRegion. A chunk needs the fields of its
+// neighbours along its edges, so they are kept for a while.
+func (heightMap *HeightMap) erodedTile(position [2]int) []float64 {
+	cache := heightMap.erosion
+	limit := 0
+	if heightMap.Erosion != nil {
+		limit = heightMap.Erosion.CachedTiles
+	}
+	cache.mutex.Lock()
+	tile, ok := cache.tiles[position]
+	if !ok {
+		tile = &erosionTile{done: make(chan struct{})}
+		cache.tiles[position] = tile
+		cache.evict(limit)
+	}
+	cache.clock++
+	tile.used = cache.clock
+	cache.mutex.Unlock()
+
+	if ok {
+		<-tile.done
+		return tile.field
+	}
+	tile.field = heightMap.solveErodedTile(position)
+	close(tile.done)
+	return tile.field
+}
+
+// evict forgets the least recently used tiles over limit, like
+// drainageCache.evict.
+func (cache *erosionCache) evict(limit int) {
+	for limit > 0 && len(cache.tiles) > limit {
+		var oldest [2]int
+		found := false
+		for key, tile := range cache.tiles {
+			select {
+			case <-tile.done:
+			default:
+				continue
+			}
+			if !found || tile.used < cache.tiles[oldest].used {
+				oldest, found = key, true
+			}
+		}
+		if !found {
+			return
+		}
+		delete(cache.tiles, oldest)
+	}
+}
+
+func (heightMap *HeightMap) solveErodedTile(position [2]int) []float64 {
+	pad, _ := heightMap.erosionMargins()
+	points := int(heightMap.ChunkNBPoints)
+	size := points + 1 + 2*pad
+	field := sampleTerrain(heightMap, position, heightMap.ChunkNBPoints, heightMap.ChunkWorldSize, pad)
+	if heightMap.Erosion != nil {
+		HydraulicErosion(field, size, position[0]*points-pad, position[1]*points-pad, DeriveSeed(heightMap.Seed, "erosion"), heightMap.Erosion)
+	}
+	if heightMap.Thermal != nil {
+		ThermalErosion(field, size, float64(heightMap.ChunkWorldSize)/float64(points), heightMap.Thermal)
+	}
+	return field
+}
+
+// erodeChunk fills chunk.Map and chunk.Rim with the eroded terrain. Near an
+// edge it blends the eroded fields of the chunks on both sides with weights
+// that only depend on the world position, summed in world order, so
+// neighbours compute the same edge vertices while every vertex is fully
+// eroded.
+func erodeChunk(chunk *Chunk, heightMap *HeightMap) {
+	pad, overlap := heightMap.erosionMargins()
+	points := int(chunk.NBPoints)
+	size := points + 1 + 2*pad
+	overlap = minInt(minInt(overlap, pad), points/2)
+
+	//weight of the tile at offset -1, 0 or 1 along an axis, at point p
+	ramp := func(p int) float64 {
+		if overlap == 0 {
+			if p < 0 {
+				return 0
+			}
+			return 1
+		}
+		t := math.Max(0, math.Min(1, float64(p+overlap)/float64(2*overlap)))
+		return t * t * (3 - 2*t)
+	}
+	weight := func(offset, p int) float64 {
+		switch offset {
+		case -1:
+			return 1 - ramp(p)
+		case 1:
+			return ramp(p - points)
+		}
+		return ramp(p) * (1 - ramp(p-points))
+	}
+
+	//the rim too, a point past the edges
+	field := make([]float64, (points+3)*(points+3))
+	var tiles [3][3][]float64
+	for x := -1; x <= points+1; x++ {
+		for z := -1; z <= points+1; z++ {
+			height := 0.0
+			for dz := -1; dz <= 1; dz++ {
+				for dx := -1; dx <= 1; dx++ {
+					w := weight(dx, x) * weight(dz, z)
+					if w == 0 {
+						continue
+					}
+					tile := tiles[dx+1][dz+1]
+					if tile == nil {
+						tile = heightMap.erodedTile(heightMap.WrapChunk([2]int{chunk.Position[0] + dx, chunk.Position[1] + dz}))
+						tiles[dx+1][dz+1] = tile
+					}
+					height += w * tile[(x-dx*points+pad)+(z-dz*points+pad)*size]
+				}
+			}
+			field[(x+1)+(z+1)*(points+3)] = height
+		}
+	}
+	splitPadded(chunk, field)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
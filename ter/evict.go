@@ -0,0 +1,173 @@
+package ter
+
+import (
+	"sort"
+	"time"
+
+	"../gfx"
+)
+
+// EvictionParams bounds the memory held by HeightMap.Chunks. Chunks within
+// Keep chunks of the camera always stay, Keep being past the load and view
+// distances so that flying back and forth over them does not reload chunks.
+// Farther chunks are evicted, the least recently seen first, while the chunks
+// take more than CPUMB of arrays or GPUMB of OpenGL buffers.
+type EvictionParams struct {
+	Keep  int
+	CPUMB int
+	GPUMB int
+}
+
+func DefaultEvictionParams() *EvictionParams {
+	return &EvictionParams{Keep: 6, CPUMB: 4096, GPUMB: 2048}
+}
+
+// Residency counts the chunks in HeightMap.Chunks and the memory they hold.
+type Residency struct {
+	Chunks   int
+	CPUBytes int
+	GPUBytes int
+}
+
+// bytes returns the memory of the chunk arrays and of its uploaded models.
+func (chunk *Chunk) bytes() (cpu, gpu int) {
+	cpu = 8 * (len(chunk.Map) + len(chunk.WaterMap) + len(chunk.LakeMap) + len(chunk.NormalY) + len(chunk.Rim) + len(chunk.Edits))
+	cpu += len(chunk.BiomeMap) + len(chunk.TreesBiome) + 8*len(chunk.TreesModelID)
+	cpu += 64 * (len(chunk.GrassTransforms) + len(chunk.TreesTransforms))
+	for _, model := range chunk.models() {
+		if model.LoadingData == nil {
+			continue
+		}
+		cpu += model.LoadingData.Bytes()
+		if model.VAO != 0 {
+			gpu += model.LoadingData.Bytes()
+		}
+	}
+	return cpu, gpu
+}
+
+// models returns the terrain and road models of the chunk, if any.
+func (chunk *Chunk) models() []*gfx.Model {
+	var models []*gfx.Model
+	if chunk.Model != nil {
+		models = chunk.TerrainModels()
+	}
+	if chunk.RoadModel != nil {
+		models = append(models, chunk.RoadModel)
+	}
+	return models
+}
+
+// Residency returns what HeightMap.Chunks holds.
+func (heightMap *HeightMap) Residency() Residency {
+	var resident Residency
+	for _, chunk := range heightMap.Chunks {
+		cpu, gpu := chunk.bytes()
+		resident.Chunks++
+		resident.CPUBytes += cpu
+		resident.GPUBytes += gpu
+	}
+	return resident
+}
+
+// chunkDistance returns the squared distance in chunks between two chunk
+// positions, the shortest way around on wrapping worlds.
+func (heightMap *HeightMap) chunkDistance(a, b [2]int) int {
+	distance := 0
+	for axis, size := range heightMap.Wrap {
+		d := a[axis] - b[axis]
+		if d < 0 {
+			d = -d
+		}
+		if size > 0 {
+			d %= size
+			if size-d < d {
+				d = size - d
+			}
+		}
+		distance += d * d
+	}
+	return distance
+}
+
+// Evict drops the far chunks over the budget, see EvictionParams, and returns
+// how many it dropped and what is left. Chunks being loaded or remeshed are
+// left alone. It deletes OpenGL buffers, so it runs on the main thread.
+func (heightMap *HeightMap) Evict(center [2]int) (int, Residency) {
+	resident := heightMap.Residency()
+	params := heightMap.Eviction
+	if params == nil {
+		return 0, resident
+	}
+
+	var far []*Chunk
+	for position, chunk := range heightMap.Chunks {
+		if chunk.Loading || heightMap.chunkDistance(position, center) <= params.Keep*params.Keep {
+			continue
+		}
+		if !chunk.Loaded {
+			//never loaded, only the entry to drop
+			delete(heightMap.Chunks, position)
+			resident.Chunks--
+			continue
+		}
+		far = append(far, chunk)
+	}
+	sort.Slice(far, func(i, j int) bool { return far[i].LastSeen.Before(far[j].LastSeen) })
+
+	evicted := 0
+	for _, chunk := range far {
+		if resident.CPUBytes <= params.CPUMB<<20 && resident.GPUBytes <= params.GPUMB<<20 {
+			break
+		}
+		cpu, gpu := chunk.bytes()
+		chunk.evict()
+		delete(heightMap.Chunks, chunk.Position)
+		resident.Chunks--
+		resident.CPUBytes -= cpu
+		resident.GPUBytes -= gpu
+		evicted++
+	}
+	return evicted, resident
+}
+
+// evict frees the OpenGL buffers and the arrays of a loaded chunk, it is back
+// to a chunk waiting to be loaded.
+func (chunk *Chunk) evict() {
+	for _, model := range chunk.models() {
+		if model.VAO != 0 {
+			gfx.DeleteModel(model)
+		}
+	}
+	*chunk = Chunk{
+		NBPoints:     chunk.NBPoints,
+		WorldSize:    chunk.WorldSize,
+		Position:     chunk.Position,
+		DrawPosition: chunk.DrawPosition,
+	}
+}
+
+// Regenerate forgets everything generated with the previous generator
+// parameters: the caches are emptied and every chunk is back to waiting to be
+// loaded. No chunk may be loading, see LoadQueue.Reset. It runs on the main
+// thread, it deletes the OpenGL buffers.
+func (heightMap *HeightMap) Regenerate() error {
+	heightMap.drainage = newDrainageCache()
+	heightMap.erosion = newErosionCache()
+	heightMap.roads = newRoadCache()
+	for _, chunk := range heightMap.Chunks {
+		chunk.evict()
+	}
+	if heightMap.Store != nil {
+		return heightMap.Store.rekey(heightMap)
+	}
+	return nil
+}
+
+// markSeen records that chunks are in view, for the least recently seen order.
+func markSeen(chunks []*Chunk) {
+	now := time.Now()
+	for _, chunk := range chunks {
+		chunk.LastSeen = now
+	}
+}
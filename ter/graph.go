@@ -0,0 +1,355 @@
+package ter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/worldsproject/noiselib"
+)
+
+// NoiseNode is one noiselib module of a NoiseGraph. Sources lists the ids of
+// the nodes plugged into the module, in SetSourceModule index order.
+type NoiseNode struct {
+	ID      string             `json:"id"`
+	Type    string             `json:"type"`
+	Sources []string           `json:"sources,omitempty"`
+	Params  map[string]float64 `json:"params,omitempty"`
+	Points  [][2]float64       `json:"points,omitempty"`
+	File    string             `json:"file,omitempty"`
+}
+
+// NoiseGraph describes how the terrain noise modules are built and chained.
+// Outputs maps the names sampled by the chunk generator ("terrain",
+// "temperature", "moisture", "density") to node ids. The old "water" output is
+// deprecated, rivers now come from the drainage network: it is still accepted
+// but no longer sampled.
+type NoiseGraph struct {
+	Nodes   []NoiseNode       `json:"nodes"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+type noiseNodeSpec struct {
+	sources  int
+	optional int //extra sources that may be left out
+	params   []string
+}
+
+var noiseNodeSpecs = map[string]noiseNodeSpec{
+	"perlin":      {0, 0, []string{"seed", "frequency", "lacunarity", "persistence", "octaveCount", "quality"}},
+	"billow":      {0, 0, []string{"seed", "frequency", "lacunarity", "persistence", "octaveCount", "quality"}},
+	"ridgedmulti": {0, 0, []string{"seed", "frequency", "lacunarity", "gain", "octaveCount", "quality"}},
+	"constant":    {0, 0, []string{"value"}},
+	"select":      {3, 0, []string{"lowerBound", "upperBound", "edgeFalloff"}},
+	"scalebias":   {1, 0, []string{"scale", "bias"}},
+	"clamp":       {1, 0, []string{"lowerBound", "upperBound"}},
+	"abs":         {1, 0, []string{}},
+	"curve":       {1, 0, []string{}},
+	//the optional source is detail noise added on top of the elevation
+	"dem": {0, 1, []string{"width", "chunkSamples", "originX", "originZ", "heightScale", "heightBias", "detailScale"}},
+	//source, then one or two warp modules
+	"warp": {2, 1, []string{"frequency", "strength", "iterations"}},
+	//land terrain, then optional coastline noise
+	"plates": {1, 1, []string{"seed", "plateSize", "landFraction", "coastWidth", "coastNoise", "shelfWidth", "shelfDepth", "slopeWidth", "oceanDepth", "uplift", "upliftWidth"}},
+}
+
+var noiseGraphOutputs = []string{"terrain", "temperature", "moisture", "density", "water"}
+
+func LoadNoiseGraph(file string) (*NoiseGraph, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	graph := &NoiseGraph{}
+	if err := json.Unmarshal(data, graph); err != nil {
+		return nil, fmt.Errorf("noise graph %s: %v", file, err)
+	}
+	if err := graph.Validate(); err != nil {
+		return nil, fmt.Errorf("noise graph %s: %v", file, err)
+	}
+	return graph, nil
+}
+
+// Validate checks node types, parameters, arity, references and cycles.
+func (graph *NoiseGraph) Validate() error {
+	nodes := map[string]*NoiseNode{}
+	for i := range graph.Nodes {
+		node := &graph.Nodes[i]
+		if node.ID == "" {
+			return fmt.Errorf("node %d has no id", i)
+		}
+		if nodes[node.ID] != nil {
+			return fmt.Errorf("duplicate node id %q", node.ID)
+		}
+		nodes[node.ID] = node
+
+		spec, ok := noiseNodeSpecs[node.Type]
+		if !ok {
+			return fmt.Errorf("node %q: unknown type %q", node.ID, node.Type)
+		}
+		if len(node.Sources) < spec.sources || len(node.Sources) > spec.sources+spec.optional {
+			if spec.optional > 0 {
+				return fmt.Errorf("node %q: %s takes %d to %d sources, got %d", node.ID, node.Type, spec.sources, spec.sources+spec.optional, len(node.Sources))
+			}
+			return fmt.Errorf("node %q: %s takes %d sources, got %d", node.ID, node.Type, spec.sources, len(node.Sources))
+		}
+		for name := range node.Params {
+			if !containsString(spec.params, name) {
+				return fmt.Errorf("node %q: unknown %s parameter %q", node.ID, node.Type, name)
+			}
+		}
+		if node.Type == "curve" && len(node.Points) < 4 {
+			return fmt.Errorf("node %q: curve needs at least 4 points", node.ID)
+		}
+		if node.Type == "warp" && node.Params["iterations"] < 0 {
+			return fmt.Errorf("node %q: warp iterations must not be negative", node.ID)
+		}
+		if node.Type == "dem" && node.File == "" {
+			return fmt.Errorf("node %q: dem needs a file", node.ID)
+		}
+	}
+
+	for _, node := range graph.Nodes {
+		for index, source := range node.Sources {
+			if nodes[source] == nil {
+				return fmt.Errorf("node %q: source %d references missing node %q", node.ID, index, source)
+			}
+		}
+	}
+
+	if graph.Outputs["terrain"] == "" {
+		return fmt.Errorf("missing \"terrain\" output")
+	}
+	for name, id := range graph.Outputs {
+		if !containsString(noiseGraphOutputs, name) {
+			return fmt.Errorf("unknown output %q", name)
+		}
+		if nodes[id] == nil {
+			return fmt.Errorf("output %q references missing node %q", name, id)
+		}
+	}
+
+	_, err := graph.sortNodes(nodes)
+	return err
+}
+
+// Build instantiates every output of the graph and plugs it into heightMap.
+func (graph *NoiseGraph) Build(heightMap *HeightMap) error {
+	if err := graph.Validate(); err != nil {
+		return err
+	}
+	nodes := map[string]*NoiseNode{}
+	for i := range graph.Nodes {
+		nodes[graph.Nodes[i].ID] = &graph.Nodes[i]
+	}
+	order, err := graph.sortNodes(nodes)
+	if err != nil {
+		return err
+	}
+
+	//sources are copied into their parents, so build them first
+	modules := map[string]noiselib.Module{}
+	for _, node := range order {
+		module, err := buildNoiseNode(node, modules, heightMap)
+		if err != nil {
+			return err
+		}
+		//wrapping worlds sample the generators on a torus
+		if heightMap.Wrap != [2]int{} {
+			module = newTorusNoise(module, heightMap.Period())
+		}
+		modules[node.ID] = module
+	}
+
+	//optional outputs stay nil
+	heightMap.Terrain = modules[graph.Outputs["terrain"]]
+	heightMap.Temperature = modules[graph.Outputs["temperature"]]
+	heightMap.Moisture = modules[graph.Outputs["moisture"]]
+	heightMap.Density = modules[graph.Outputs["density"]]
+
+	//anything derived from the old terrain is stale
+	heightMap.drainage = newDrainageCache()
+	heightMap.erosion = newErosionCache()
+	heightMap.roads = newRoadCache()
+	return nil
+}
+
+// sortNodes returns the nodes reachable from the outputs, sources first.
+func (graph *NoiseGraph) sortNodes(nodes map[string]*NoiseNode) ([]*NoiseNode, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	order := []*NoiseNode{}
+
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("cycle through %v", append(path, id))
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		for _, source := range nodes[id].Sources {
+			if err := visit(source, append(path, id)); err != nil {
+				return err
+			}
+		}
+		state[id] = done
+		order = append(order, nodes[id])
+		return nil
+	}
+
+	//deterministic error messages
+	var names []string
+	for name := range graph.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(graph.Outputs[name], nil); err != nil {
+			return nil, err
+		}
+	}
+	//unreachable nodes must not hide a cycle either
+	for _, node := range graph.Nodes {
+		if err := visit(node.ID, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func buildNoiseNode(node *NoiseNode, modules map[string]noiselib.Module, heightMap *HeightMap) (noiselib.Module, error) {
+	param := func(name string, value float64) float64 {
+		if v, ok := node.Params[name]; ok {
+			return v
+		}
+		return value
+	}
+	source := func(index int) noiselib.Module {
+		return modules[node.Sources[index]]
+	}
+	//the "seed" parameter only picks a stream, the world seed drives it
+	seed := noiseSeed(heightMap.Seed, node.ID+"/"+strconv.Itoa(int(param("seed", 0))))
+
+	switch node.Type {
+	case "perlin":
+		module := noiselib.DefaultPerlin()
+		module.Seed = seed
+		module.Frequency = param("frequency", module.Frequency)
+		module.Lacunarity = param("lacunarity", module.Lacunarity)
+		module.Persistence = param("persistence", module.Persistence)
+		module.OctaveCount = int(param("octaveCount", float64(module.OctaveCount)))
+		module.Quality = int(param("quality", float64(module.Quality)))
+		return module, nil
+	case "billow":
+		module := noiselib.DefaultBillow()
+		module.Seed = seed
+		module.Frequency = param("frequency", module.Frequency)
+		module.Lacunarity = param("lacunarity", module.Lacunarity)
+		module.Persistence = param("persistence", module.Persistence)
+		module.OctaveCount = int(param("octaveCount", float64(module.OctaveCount)))
+		module.Quality = int(param("quality", float64(module.Quality)))
+		return module, nil
+	case "ridgedmulti":
+		module := noiselib.DefaultRidgedmulti()
+		module.Seed = seed
+		module.Frequency = param("frequency", module.Frequency)
+		module.Lacunarity = param("lacunarity", module.Lacunarity)
+		module.Gain = param("gain", module.Gain)
+		module.OctaveCount = int(param("octaveCount", float64(module.OctaveCount)))
+		module.Quality = int(param("quality", float64(module.Quality)))
+		return module, nil
+	case "constant":
+		return noiselib.Constant{param("value", 0.0)}, nil
+	case "select":
+		module := noiselib.DefaultSelect()
+		for i := range node.Sources {
+			module.SetSourceModule(i, source(i))
+		}
+		module.SetBounds(param("lowerBound", module.LowerBound), param("upperBound", module.UpperBound))
+		module.SetEdgeFalloff(param("edgeFalloff", module.EdgeFalloff))
+		return module, nil
+	case "scalebias":
+		module := noiselib.DefaultScaleBias()
+		module.SetSourceModule(0, source(0))
+		module.Scale = param("scale", module.Scale)
+		module.Bias = param("bias", module.Bias)
+		return module, nil
+	case "clamp":
+		module := noiselib.Clamp{SourceModule: make([]noiselib.Module, 1)}
+		module.SetSourceModule(0, source(0))
+		module.SetBounds(param("lowerBound", -1.0), param("upperBound", 1.0))
+		return module, nil
+	case "abs":
+		module := noiselib.Abs{SourceModule: make([]noiselib.Module, 1)}
+		module.SetSourceModule(0, source(0))
+		return module, nil
+	case "curve":
+		module := noiselib.Curve{SourceModule: make([]noiselib.Module, 1)}
+		module.SetSourceModule(0, source(0))
+		for _, point := range node.Points {
+			module.AddControlPoint(point[0], point[1])
+		}
+		return module, nil
+	case "dem":
+		module, err := LoadElevation(node.File, int(param("width", 0)))
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %v", node.ID, err)
+		}
+		//origin in chunks, one chunk covers chunkSamples samples
+		module.CellSize = float64(heightMap.ChunkWorldSize) / param("chunkSamples", 64)
+		module.OriginX = param("originX", 0) * float64(heightMap.ChunkWorldSize)
+		module.OriginZ = param("originZ", 0) * float64(heightMap.ChunkWorldSize)
+		module.Scale = param("heightScale", 1.0)
+		module.Bias = param("heightBias", 0.0)
+		if len(node.Sources) > 0 {
+			module.SetSourceModule(0, source(0))
+			module.DetailScale = param("detailScale", 1.0)
+		}
+		return module, nil
+	case "warp":
+		module := DefaultWarp()
+		module.Frequency = param("frequency", module.Frequency)
+		module.Strength = param("strength", module.Strength)
+		module.Iterations = int(param("iterations", float64(module.Iterations)))
+		for i := range node.Sources {
+			module.SetSourceModule(i, source(i))
+		}
+		return module, nil
+	case "plates":
+		module := DefaultPlates()
+		module.Seed = int64(seed)
+		module.PlateSize = param("plateSize", module.PlateSize)
+		module.LandFraction = param("landFraction", module.LandFraction)
+		module.CoastWidth = param("coastWidth", module.CoastWidth)
+		module.CoastNoise = param("coastNoise", module.CoastNoise)
+		module.ShelfWidth = param("shelfWidth", module.ShelfWidth)
+		module.ShelfDepth = param("shelfDepth", module.ShelfDepth)
+		module.SlopeWidth = param("slopeWidth", module.SlopeWidth)
+		module.OceanDepth = param("oceanDepth", module.OceanDepth)
+		module.Uplift = param("uplift", module.Uplift)
+		module.UpliftWidth = param("upliftWidth", module.UpliftWidth)
+		module.Period = heightMap.Period()
+		for i := range node.Sources {
+			module.SetSourceModule(i, source(i))
+		}
+		return module, nil
+	}
+	return nil, fmt.Errorf("node %q: unknown type %q", node.ID, node.Type)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -11,33 +11,43 @@ type HeightMap struct {
 	ChunkWorldSize uint32
 	NbOctaves      uint32
 	Exponent 	   float64
+	Seed           int64
 	Chunks         map[[2]int]*Chunk
 
-	Perlin         noiselib.Perlin
-
-	//mountains
-	MountainNoise noiselib.Ridgedmulti
-	MountainScaleBias noiselib.ScaleBias
-	//rivers
-	RiverNoise noiselib.Ridgedmulti
-	RiverAbs   noiselib.Abs
-	RiverScaleBias noiselib.ScaleBias
-	RiverCurve noiselib.Curve
-	RiverClamp noiselib.Clamp
-
-	//flat terrain
-	PlainNoise     noiselib.Billow
-	PlainScaleBias noiselib.ScaleBias
-	//rivers in flat terrain
-	PlainAndRiver noiselib.Select
-	//terrain type selector
-	TerrainType    noiselib.Perlin
-	//Final Terrain
-	FinalTerrain   noiselib.Select
+	//built from a NoiseGraph
+	Terrain     noiselib.Module
+	Temperature noiselib.Module
+	Moisture    noiselib.Module
+	Density     noiselib.Module //3D, only sampled by voxel chunks
+
+	//nil disables the pass
+	Erosion *ErosionParams
+	Thermal *ThermalParams
+	Rivers  *RiverParams
+	Roads   *RoadParams
+
+	//nil meshes every chunk at full resolution
+	LOD *LODParams
+
+	//nil keeps every chunk loaded once
+	Eviction *EvictionParams
+
+	//nil keeps heightfield chunks
+	Volume *VolumeParams
+	//nil generates every chunk
+	Store *ChunkStore
+	//sculpted deltas, nil disables sculpting
+	Edits *EditLayer
+	//world size in chunks, 0 keeps the axis infinite, see WrapChunk
+	Wrap [2]int
+
+	drainage *drainageCache
+	erosion  *erosionCache
+	roads    *roadCache
 }
 
 func getMapValue(heightMap *HeightMap, position [2] float64) float64{
-	return heightMap.FinalTerrain.GetValue(position[0], 0, position[1])
+	return heightMap.Terrain.GetValue(position[0], 0, position[1])
 }
 
 func CreateChunkPolyMesh(chunk Chunk, textureContainer *ChunkTextureContainer, heightMap *HeightMap) gfx.Mesh {
@@ -52,60 +62,23 @@ func CreateChunkPolyMesh(chunk Chunk, textureContainer *ChunkTextureContainer, h
 	for x:=0; x < size+1; x++{
 		for z:=0; z < size+1; z++ {
 			position := mgl32.Vec3{float32(x) * step, float32(-chunk.Map[x + z * (size+1)]), float32(z) * step}
-			//compute normal
-			var up float64 = 0.0
-			var down float64 = 0.0
-			var left float64 = 0.0
-			var right float64 = 0.0
-			{
-				//up = -heightMap.FinalTerrain.GetValue(float64(x + size * chunk.Position[0])*float64(step), 0, float64(z + size * chunk.Position[1] - 1)*float64(step))
-
-				if z > 10 {
-					up = -chunk.Map[x+(z-1)*(size+1)]
-				} else {
-					up = -heightMap.FinalTerrain.GetValue(float64(x + size * chunk.Position[0])*float64(step), 0, float64(z + size * chunk.Position[1] - 1)*float64(step))
-				}
-				if z < size-10 {
-					down = -chunk.Map[x+(z+1)*(size+1)]
-				} else {
-					down = -heightMap.FinalTerrain.GetValue(float64(x + size * chunk.Position[0])*float64(step), 0, float64(z + size * chunk.Position[1] + 1)*float64(step))
-				}
-				if x > 10 {
-					left = -chunk.Map[x-1+z*(size+1)]
-				} else {
-					left = -heightMap.FinalTerrain.GetValue(float64(x + size * chunk.Position[0] - 1)*float64(step), 0, float64(z + size * chunk.Position[1])*float64(step))
-				}
-				if x < size-10 {
-					right = -chunk.Map[x+1+z*(size+1)]
-				} else {
-					right = -heightMap.FinalTerrain.GetValue(float64(x + size * chunk.Position[0] + 1)*float64(step), 0, float64(z + size * chunk.Position[1])*float64(step))
-				}
+			//lakes are drawn at their flat surface, Map keeps the bed
+			if chunk.LakeMap[x + z * (size+1)] > chunk.Map[x + z * (size+1)] {
+				position[1] = float32(-chunk.LakeMap[x + z * (size+1)])
 			}
+			//compute normal
+			//past the edges the rim, as the neighbours generate it
+			up := -chunk.heightAround(heightMap, x, z-1)
+			down := -chunk.heightAround(heightMap, x, z+1)
+			left := -chunk.heightAround(heightMap, x-1, z)
+			right := -chunk.heightAround(heightMap, x+1, z)
 			normal := mgl32.Vec3{float32(left - right) / step, -2, float32(down - up) / step}
 			normal = normal.Normalize()
 
-			var color mgl32.Vec4
-			height := -position.Y()
-			if(height > 1.5) {
-				color = mgl32.Vec4{1.0, 1.0, 1.0, 1.0}
-				textureID = textureContainer.SnowID
-			}else if(height > 0.8){
-				color = mgl32.Vec4{0.4, 0.4, 0.4, 1.0}
-				textureID = textureContainer.RockID
-			}else if(height > -0.2){
-				color = mgl32.Vec4{0.0, 0.4, 0.0, 1.0}
-				textureID = textureContainer.GrassID
-			}else if height > -0.5{
-				color = mgl32.Vec4{0.7, 0.7, 0.0, 1.0}
-				textureID = textureContainer.SandID
-			}else if height > -1{
-				color = mgl32.Vec4{0.0, 0.3, 0.5, 1.0}
-				//textureID = textureContainer.SnowID
-			}else{
-				color = mgl32.Vec4{0.0, 0.0, 0.7, 1.0}
-				//textureID = textureContainer.SnowID
-			}
-			color = mgl32.Vec4{color.X(), color.Y(), color.Z(), -float32(chunk.WaterMap[x + z * (size+1)])}
+			biome := Biomes[chunk.BiomeMap[x + z * (size+1)]]
+			color := biome.Color
+			textureID = textureContainer.GroundID(biome.Ground)
+			color = mgl32.Vec4{color.X(), color.Y(), color.Z(), float32(chunk.WaterMap[x + z * (size+1)])}
 			chunk.NormalY[x + z * (size + 1)] = float64(normal.Y())
 			var textureScale float64 = 1.0/16.0
 
@@ -118,6 +91,7 @@ func CreateChunkPolyMesh(chunk Chunk, textureContainer *ChunkTextureContainer, h
 				Texture:  texture,
 			}
 			mesh.Vertices = append(mesh.Vertices, v)
+			mesh.Ground = append(mesh.Ground, biome.Ground.Weights())
 		}
 	}
 
@@ -0,0 +1,269 @@
+package ter
+
+import (
+	"math"
+	"sort"
+)
+
+// Command is an undoable edit. Undo and Redo return the chunks to remesh.
+type Command interface {
+	Undo() [][2]int
+	Redo() [][2]int
+	Size() int //bytes kept by the command
+}
+
+// History keeps the commands to undo and redo, dropping the oldest ones once
+// they take more than MaxBytes.
+type History struct {
+	MaxBytes int
+
+	done   []Command
+	undone []Command
+	bytes  int
+}
+
+func NewHistory(maxBytes int) *History {
+	return &History{MaxBytes: maxBytes}
+}
+
+// Push records a command that has just been done, the redo list is dropped.
+func (history *History) Push(command Command) {
+	for _, undone := range history.undone {
+		history.bytes -= undone.Size()
+	}
+	history.undone = nil
+	history.done = append(history.done, command)
+	history.bytes += command.Size()
+	for history.bytes > history.MaxBytes && len(history.done) > 1 {
+		history.bytes -= history.done[0].Size()
+		history.done[0] = nil
+		history.done = history.done[1:]
+	}
+}
+
+// Undo reverts the last command, ok is false when there is none.
+func (history *History) Undo() (chunks [][2]int, ok bool) {
+	if len(history.done) == 0 {
+		return nil, false
+	}
+	command := history.done[len(history.done)-1]
+	history.done = history.done[:len(history.done)-1]
+	history.undone = append(history.undone, command)
+	return command.Undo(), true
+}
+
+// Redo does the last undone command again, ok is false when there is none.
+func (history *History) Redo() (chunks [][2]int, ok bool) {
+	if len(history.undone) == 0 {
+		return nil, false
+	}
+	command := history.undone[len(history.undone)-1]
+	history.undone = history.undone[:len(history.undone)-1]
+	history.done = append(history.done, command)
+	return command.Redo(), true
+}
+
+// Bytes returns the memory kept by the history.
+func (history *History) Bytes() int {
+	return history.bytes
+}
+
+// Stroke is what one sculpting stroke changed in the edit layer, only the
+// points it moved are kept, per chunk.
+type Stroke struct {
+	Edits *EditLayer
+	Tiles map[[2]int]*TileDiff
+
+	recording map[[2]int]map[int32]float64
+}
+
+// TileDiff holds the deltas a stroke added to some points of a tile.
+type TileDiff struct {
+	Indices []int32
+	Deltas  []float64
+}
+
+// BeginStroke starts recording the edits into a new stroke.
+func (edits *EditLayer) BeginStroke() {
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	edits.stroke = &Stroke{Edits: edits, recording: make(map[[2]int]map[int32]float64)}
+}
+
+// EndStroke stops recording and returns the stroke, nil if nothing changed.
+func (edits *EditLayer) EndStroke() *Stroke {
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	stroke := edits.stroke
+	edits.stroke = nil
+	if stroke == nil || len(stroke.recording) == 0 {
+		return nil
+	}
+
+	stroke.Tiles = make(map[[2]int]*TileDiff)
+	for position, points := range stroke.recording {
+		diff := &TileDiff{}
+		for index := range points {
+			diff.Indices = append(diff.Indices, index)
+		}
+		sort.Slice(diff.Indices, func(i, j int) bool { return diff.Indices[i] < diff.Indices[j] })
+		for _, index := range diff.Indices {
+			diff.Deltas = append(diff.Deltas, points[index])
+		}
+		stroke.Tiles[position] = diff
+	}
+	stroke.recording = nil
+	return stroke
+}
+
+// Stroking tells if a stroke is being recorded.
+func (edits *EditLayer) Stroking() bool {
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	return edits.stroke != nil
+}
+
+func (stroke *Stroke) record(position [2]int, index int, delta float64) {
+	if stroke.recording[position] == nil {
+		stroke.recording[position] = make(map[int32]float64)
+	}
+	stroke.recording[position][int32(index)] += delta
+}
+
+// apply adds the stroke deltas times sign to the edit layer.
+func (stroke *Stroke) apply(sign float64) [][2]int {
+	edits := stroke.Edits
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+	var chunks [][2]int
+	points := int(edits.NBPoints) + 1
+	for position, diff := range stroke.Tiles {
+		tile := edits.Tiles[position]
+		if tile == nil {
+			tile = make([]float64, points*points)
+			edits.Tiles[position] = tile
+		}
+		for i, index := range diff.Indices {
+			tile[index] += sign * diff.Deltas[i]
+		}
+		//an undone tile would count as edited and be saved
+		if emptyTile(tile) {
+			delete(edits.Tiles, position)
+		}
+		chunks = append(chunks, position)
+	}
+	return chunks
+}
+
+// emptyTile tells if a tile has no delta left, up to the rounding of strokes
+// undone in another order than they were applied.
+func emptyTile(tile []float64) bool {
+	for _, delta := range tile {
+		if math.Abs(delta) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func (stroke *Stroke) Undo() [][2]int {
+	return stroke.apply(-1)
+}
+
+func (stroke *Stroke) Redo() [][2]int {
+	return stroke.apply(1)
+}
+
+func (stroke *Stroke) Size() int {
+	size := 0
+	for _, diff := range stroke.Tiles {
+		size += 12*len(diff.Indices) + 64
+	}
+	return size
+}
+
+// BrushChange is a change of the brush tool or size.
+type BrushChange struct {
+	Brush         *Brush
+	Before, After Brush
+}
+
+func (change *BrushChange) Undo() [][2]int {
+	*change.Brush = change.Before
+	return nil
+}
+
+func (change *BrushChange) Redo() [][2]int {
+	*change.Brush = change.After
+	return nil
+}
+
+func (change *BrushChange) Size() int {
+	return 80
+}
+
+// PlantChange is a tree planted or removed by hand, see HeightMap.Plant.
+type PlantChange struct {
+	Edits  *EditLayer
+	After  PlantEdit //what was asked, the points may differ
+	Points []PlantPoint
+}
+
+// PlantPoint is the edit of a point of a chunk grid.
+type PlantPoint struct {
+	Position      [2]int
+	Index         int32
+	Before, After PlantEdit
+}
+
+func (change *PlantChange) Undo() [][2]int {
+	var chunks [][2]int
+	for _, point := range change.Points {
+		change.Edits.setPlant(point.Position, point.Index, point.Before)
+		chunks = append(chunks, point.Position)
+	}
+	return chunks
+}
+
+func (change *PlantChange) Redo() [][2]int {
+	var chunks [][2]int
+	for _, point := range change.Points {
+		change.Edits.setPlant(point.Position, point.Index, point.After)
+		chunks = append(chunks, point.Position)
+	}
+	return chunks
+}
+
+func (change *PlantChange) Size() int {
+	return 48 + 24*len(change.Points)
+}
+
+// ParamChange is a change of a generator parameter. Chunks can not be
+// remeshed with it, Regenerate generates the world again. Workers read the
+// parameters, Quiesce stops them before the value is written.
+type ParamChange struct {
+	Value         *float64
+	Before, After float64
+	Quiesce       func()
+	Regenerate    func()
+}
+
+func (change *ParamChange) set(value float64) {
+	change.Quiesce()
+	*change.Value = value
+	change.Regenerate()
+}
+
+func (change *ParamChange) Undo() [][2]int {
+	change.set(change.Before)
+	return nil
+}
+
+func (change *ParamChange) Redo() [][2]int {
+	change.set(change.After)
+	return nil
+}
+
+func (change *ParamChange) Size() int {
+	return 48
+}
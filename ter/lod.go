@@ -0,0 +1,292 @@
+package ter
+
+import (
+	"math"
+
+	"../gfx"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// LODParams configures the chunk levels of detail. Level l meshes every 2^l
+// points and is drawn up to Distance*2^l from the camera, the last level
+// beyond. Over the last Morph share of its range a level morphs into the next
+// one in the vertex shader, so switching does not pop, and skirts hang under
+// the chunk edges to hide the cracks between chunks of different levels.
+// With Simplify the last level is rather simplified from the one before, so
+// plains take a few large triangles and rough ground keeps more. It is used
+// when it has fewer triangles than the regular grid, the level before then
+// morphs into it.
+type LODParams struct {
+	Levels   int
+	Distance float64 //world units, end of the level 0 range
+	Morph    float64
+	Skirt    float64 //rendered units
+	Simplify float64 //error bound in heightmap units, 0 keeps the regular grid
+}
+
+func DefaultLODParams() *LODParams {
+	return &LODParams{Levels: 4, Distance: 12, Morph: 0.3, Skirt: 0.2, Simplify: 0.005}
+}
+
+// noMorph is a morph range no vertex reaches.
+var noMorph = [2]float32{math.MaxFloat32 / 2, math.MaxFloat32}
+
+// levels returns how many levels a chunk of nbPoints gets, the coarsest one
+// must still fall on the points.
+func (params *LODParams) levels(nbPoints uint32) int {
+	levels := 1
+	for levels < params.Levels && nbPoints%(1<<uint(levels)) == 0 && nbPoints>>uint(levels) >= 2 {
+		levels++
+	}
+	return levels
+}
+
+// Level returns the level drawn at distance, and the distances over which it
+// morphs into the next one.
+func (params *LODParams) Level(distance float64, levels int) (int, [2]float32) {
+	for level := 0; level < levels-1; level++ {
+		end := params.Distance * float64(int(1)<<uint(level))
+		if distance < end {
+			start := 0.0
+			if level > 0 {
+				start = end / 2
+			}
+			return level, [2]float32{float32(end - params.Morph*(end-start)), float32(end)}
+		}
+	}
+	return levels - 1, noMorph
+}
+
+// createLODMeshes derives the levels of detail from the full mesh of a chunk,
+// as built by CreateChunkPolyMesh, level 0 being the full mesh with skirts.
+func createLODMeshes(full gfx.Mesh, chunk *Chunk, params *LODParams) []gfx.Mesh {
+	size := int(chunk.NBPoints)
+	levels := params.levels(chunk.NBPoints)
+	//mesh Y is doubled when rendered
+	skirt := float32(params.Skirt / 2)
+	//CreateChunkPolyMesh adds the vertices x major
+	y := func(x, z int) float32 {
+		return full.Vertices[x*(size+1)+z].Position.Y()
+	}
+
+	meshes := make([]gfx.Mesh, levels)
+	for level := range meshes {
+		stride := 1 << uint(level)
+		points := size/stride + 1
+		mesh := gfx.Mesh{TextureID: full.TextureID}
+		for x := 0; x <= size; x += stride {
+			for z := 0; z <= size; z += stride {
+				mesh.Vertices = append(mesh.Vertices, full.Vertices[x*(size+1)+z])
+				mesh.Ground = append(mesh.Ground, full.Ground[x*(size+1)+z])
+				//the next level drops the odd points, they move onto its triangles
+				morph := float32(0)
+				if level < levels-1 {
+					oddX, oddZ := (x/stride)%2 == 1, (z/stride)%2 == 1
+					switch {
+					case oddX && oddZ:
+						//the diagonal of the coarser cell, as the triangles below split it
+						morph = (y(x-stride, z+stride)+y(x+stride, z-stride))/2 - y(x, z)
+					case oddX:
+						morph = (y(x-stride, z)+y(x+stride, z))/2 - y(x, z)
+					case oddZ:
+						morph = (y(x, z-stride)+y(x, z+stride))/2 - y(x, z)
+					}
+				}
+				mesh.Morph = append(mesh.Morph, morph)
+			}
+		}
+
+		for a := 0; a < points-1; a++ {
+			for b := 0; b < points-1; b++ {
+				i := uint32(a + points*b)
+				mesh.Connectivity = append(mesh.Connectivity,
+					gfx.TriangleConnectivity{i, i + 1, i + uint32(points)},
+					gfx.TriangleConnectivity{i + 1, i + uint32(points) + 1, i + uint32(points)})
+			}
+		}
+
+		//skirts, Y grows downward
+		edges := [4][2][2]int{
+			{{0, 0}, {0, 1}}, {{points - 1, 0}, {0, 1}},
+			{{0, 0}, {1, 0}}, {{0, points - 1}, {1, 0}},
+		}
+		for _, edge := range edges {
+			first := uint32(len(mesh.Vertices))
+			for k := 0; k < points; k++ {
+				top := (edge[0][0]+k*edge[1][0])*points + edge[0][1] + k*edge[1][1]
+				vertex := mesh.Vertices[top]
+				vertex.Position = vertex.Position.Add(mgl32.Vec3{0, skirt, 0})
+				mesh.Vertices = append(mesh.Vertices, vertex)
+				mesh.Morph = append(mesh.Morph, mesh.Morph[top])
+				mesh.Ground = append(mesh.Ground, mesh.Ground[top])
+			}
+			for k := 0; k < points-1; k++ {
+				top0 := uint32((edge[0][0]+k*edge[1][0])*points + edge[0][1] + k*edge[1][1])
+				top1 := uint32((edge[0][0]+(k+1)*edge[1][0])*points + edge[0][1] + (k+1)*edge[1][1])
+				bottom0, bottom1 := first+uint32(k), first+uint32(k+1)
+				mesh.Connectivity = append(mesh.Connectivity,
+					gfx.TriangleConnectivity{top0, top1, bottom0},
+					gfx.TriangleConnectivity{top1, bottom1, bottom0})
+				mesh.Skirts += 2
+			}
+		}
+		meshes[level] = mesh
+	}
+
+	if params.Simplify > 0 && levels > 2 {
+		last := meshes[levels-1]
+		simplified := gfx.Simplify(&meshes[levels-2], gfx.SimplifyParams{MaxError: params.Simplify, Up: mgl32.Vec3{0, -1, 0}})
+		//rough chunks may need more triangles than the grid, it is kept then
+		if len(simplified.Connectivity) < len(last.Connectivity) {
+			simplified.Morph = make([]float32, len(simplified.Vertices))
+			meshes[levels-1] = simplified
+			//the level before now morphs into the simplified surface
+			size := int(chunk.NBPoints)>>uint(levels-2) + 1
+			morphOnto(&meshes[levels-2], &simplified, size*size, skirt)
+		}
+	}
+	return meshes
+}
+
+// morphOnto sets the morph of mesh so its vertices land on the surface of
+// target, seen from above. The first surface vertices of mesh are on the
+// surface, the others on the skirts, skirt lower.
+func morphOnto(mesh *gfx.Mesh, target *gfx.Mesh, surface int, skirt float32) {
+	grid := newTriangleGrid(target)
+	for i, vertex := range mesh.Vertices {
+		p := vertex.Position
+		top := p.Y()
+		if i >= surface {
+			top -= skirt
+		}
+		for _, tri := range grid.at(p.X(), p.Z()) {
+			a := target.Vertices[tri.U0].Position
+			b := target.Vertices[tri.U1].Position
+			c := target.Vertices[tri.U2].Position
+			if p.X() < minFloat32(a.X(), b.X(), c.X()) || p.X() > maxFloat32(a.X(), b.X(), c.X()) ||
+				p.Z() < minFloat32(a.Z(), b.Z(), c.Z()) || p.Z() > maxFloat32(a.Z(), b.Z(), c.Z()) {
+				continue
+			}
+			//barycentric coordinates in the x,z plane
+			area := (b.X()-a.X())*(c.Z()-a.Z()) - (c.X()-a.X())*(b.Z()-a.Z())
+			if area == 0 {
+				continue
+			}
+			u := ((b.X()-p.X())*(c.Z()-p.Z()) - (c.X()-p.X())*(b.Z()-p.Z())) / area
+			v := ((c.X()-p.X())*(a.Z()-p.Z()) - (a.X()-p.X())*(c.Z()-p.Z())) / area
+			w := 1 - u - v
+			const epsilon = -1e-4
+			if u < epsilon || v < epsilon || w < epsilon {
+				continue
+			}
+			mesh.Morph[i] = u*a.Y() + v*b.Y() + w*c.Y() - top
+			break
+		}
+	}
+}
+
+// triangleGrid buckets the surface triangles of a mesh by the cells of a
+// regular grid over x,z their bounds overlap.
+type triangleGrid struct {
+	MinX, MinZ float32
+	Cell       float32
+	Size       int
+	Cells      [][]gfx.TriangleConnectivity
+}
+
+func newTriangleGrid(mesh *gfx.Mesh) *triangleGrid {
+	triangles := mesh.Connectivity[:len(mesh.Connectivity)-mesh.Skirts]
+	grid := &triangleGrid{Size: 1 + int(math.Sqrt(float64(len(triangles))))}
+	if len(mesh.Vertices) == 0 {
+		grid.Cells = make([][]gfx.TriangleConnectivity, 1)
+		grid.Size, grid.Cell = 1, 1
+		return grid
+	}
+	first := mesh.Vertices[0].Position
+	minX, maxX, minZ, maxZ := first.X(), first.X(), first.Z(), first.Z()
+	for _, vertex := range mesh.Vertices {
+		p := vertex.Position
+		minX, maxX = minFloat32(minX, minX, p.X()), maxFloat32(maxX, maxX, p.X())
+		minZ, maxZ = minFloat32(minZ, minZ, p.Z()), maxFloat32(maxZ, maxZ, p.Z())
+	}
+	grid.MinX, grid.MinZ = minX, minZ
+	grid.Cell = maxFloat32(maxX-minX, maxZ-minZ, 1e-6) / float32(grid.Size)
+	grid.Cells = make([][]gfx.TriangleConnectivity, grid.Size*grid.Size)
+	for _, tri := range triangles {
+		a := mesh.Vertices[tri.U0].Position
+		b := mesh.Vertices[tri.U1].Position
+		c := mesh.Vertices[tri.U2].Position
+		lowX, lowZ := grid.cell(minFloat32(a.X(), b.X(), c.X()), minFloat32(a.Z(), b.Z(), c.Z()))
+		highX, highZ := grid.cell(maxFloat32(a.X(), b.X(), c.X()), maxFloat32(a.Z(), b.Z(), c.Z()))
+		for x := lowX; x <= highX; x++ {
+			for z := lowZ; z <= highZ; z++ {
+				grid.Cells[x+z*grid.Size] = append(grid.Cells[x+z*grid.Size], tri)
+			}
+		}
+	}
+	return grid
+}
+
+// cell returns the cell holding (x, z), clamped to the grid.
+func (grid *triangleGrid) cell(x, z float32) (int, int) {
+	clamp := func(v float32) int {
+		return minInt(maxInt(int(v/grid.Cell), 0), grid.Size-1)
+	}
+	return clamp(x - grid.MinX), clamp(z - grid.MinZ)
+}
+
+// at returns the triangles that may cover (x, z).
+func (grid *triangleGrid) at(x, z float32) []gfx.TriangleConnectivity {
+	cellX, cellZ := grid.cell(x, z)
+	return grid.Cells[cellX+cellZ*grid.Size]
+}
+
+func minFloat32(a, b, c float32) float32 {
+	return float32(math.Min(float64(a), math.Min(float64(b), float64(c))))
+}
+
+func maxFloat32(a, b, c float32) float32 {
+	return float32(math.Max(float64(a), math.Max(float64(b), float64(c))))
+}
+
+// buildLODModels fills the model data of every level, level 0 is chunk.Model.
+func buildLODModels(full gfx.Mesh, chunk *Chunk, params *LODParams) []*gfx.Model {
+	var models []*gfx.Model
+	for _, mesh := range createLODMeshes(full, chunk, params) {
+		model := new(gfx.Model)
+		model.LoadingData = gfx.FillModelData(&mesh)
+		models = append(models, model)
+	}
+	return models
+}
+
+// DrawModel returns the model of the level of detail picked by GetRenderList.
+func (chunk *Chunk) DrawModel() *gfx.Model {
+	if chunk.LOD < len(chunk.LODModels) {
+		return chunk.LODModels[chunk.LOD]
+	}
+	return chunk.Model
+}
+
+// TerrainModels returns the terrain models of a chunk, every level of detail.
+func (chunk *Chunk) TerrainModels() []*gfx.Model {
+	if len(chunk.LODModels) > 0 {
+		return chunk.LODModels
+	}
+	return []*gfx.Model{chunk.Model}
+}
+
+// selectLOD picks the level of detail of a chunk from its distance to the
+// camera, in the x,z plane like the vertex shader morphing.
+func selectLOD(heightMap *HeightMap, chunk *Chunk, camera mgl32.Vec3) {
+	chunk.LOD, chunk.MorphRange = 0, noMorph
+	if heightMap.LOD == nil || len(chunk.LODModels) == 0 {
+		return
+	}
+	worldSize := float64(chunk.WorldSize)
+	minX, minZ := float64(chunk.DrawPosition[0])*worldSize, float64(chunk.DrawPosition[1])*worldSize
+	dx := math.Max(0, math.Max(minX-float64(camera.X()), float64(camera.X())-minX-worldSize))
+	dz := math.Max(0, math.Max(minZ-float64(camera.Z()), float64(camera.Z())-minZ-worldSize))
+	chunk.LOD, chunk.MorphRange = heightMap.LOD.Level(math.Hypot(dx, dz), len(chunk.LODModels))
+}
@@ -0,0 +1,274 @@
+package ter
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/worldsproject/noiselib"
+)
+
+// Plates is the continent layer. The plane is split into Voronoi plates, one
+// per cell of a PlateSize grid, each either continental or oceanic and
+// drifting in its own direction. Continental plates carry the land terrain
+// down to the sea level at their coasts, oceanic plates get a continental
+// shelf, a slope and the deep ocean floor. Converging boundaries are uplifted
+// into mountain ranges and island arcs, diverging oceanic ones into ridges.
+// Distances are in world units, heights in heightmap units.
+type Plates struct {
+	Land  noiselib.Module //terrain of continental plates
+	Coast noiselib.Module //optional, moves the coastline by CoastNoise
+
+	Seed         int64
+	PlateSize    float64
+	LandFraction float64 //share of continental plates
+	CoastWidth   float64 //from the coast to the full land terrain
+	CoastNoise   float64
+	ShelfWidth   float64
+	ShelfDepth   float64 //under the sea level, at the shelf edge
+	SlopeWidth   float64
+	OceanDepth   float64 //under the sea level
+	Uplift       float64
+	UpliftWidth  float64
+	Period       [2]float64 //world size on wrapping worlds, 0 for an infinite axis
+
+	//plates around recently sampled cells, see neighbourhood
+	cells [plateCacheSlots]atomic.Value
+}
+
+// plateCacheSlots bounds the cells whose neighbourhood is kept, a chunk only
+// spans a few of them.
+const plateCacheSlots = 256
+
+func DefaultPlates() *Plates {
+	return &Plates{
+		PlateSize:    240,
+		LandFraction: 0.5,
+		CoastWidth:   24,
+		CoastNoise:   12,
+		ShelfWidth:   24,
+		ShelfDepth:   0.2,
+		SlopeWidth:   36,
+		OceanDepth:   2.0,
+		Uplift:       1.0,
+		UpliftWidth:  18,
+	}
+}
+
+type plate struct {
+	site        [2]float64
+	drift       float64 //direction, radians
+	continental bool
+}
+
+// wrapCells returns how many plates fit along each axis of a wrapping world, 0
+// for an infinite axis.
+func (plates *Plates) wrapCells() [2]int {
+	var cells [2]int
+	for axis, period := range plates.Period {
+		if period > 0 {
+			cells[axis] = maxInt(1, int(math.Floor(period/plates.PlateSize+0.5)))
+		}
+	}
+	return cells
+}
+
+// plateAt returns the plate of a grid cell. The four plates around the
+// origin are continental, so the camera starts on land. On wrapping worlds
+// cells repeat every wrapCells() plates.
+func (plates *Plates) plateAt(cellX, cellZ int) plate {
+	cells := plates.wrapCells()
+	wrappedX, wrappedZ := cellX, cellZ
+	if cells[0] > 0 {
+		wrappedX = cellX - floorDiv(cellX, cells[0])*cells[0]
+	}
+	if cells[1] > 0 {
+		wrappedZ = cellZ - floorDiv(cellZ, cells[1])*cells[1]
+	}
+	h := mix64(uint64(plates.Seed) ^ uint64(int64(wrappedX))*0x9e3779b97f4a7c15 ^ uint64(int64(wrappedZ))*0xc2b2ae3d27d4eb4f)
+	random := func() float64 {
+		h = mix64(h + 0x9e3779b97f4a7c15)
+		return float64(h>>11) / (1 << 53)
+	}
+	p := plate{}
+	//sites stay away from the cell borders so plates keep a sensible size
+	p.site[0] = (float64(cellX) + 0.1 + 0.8*random()) * plates.PlateSize
+	p.site[1] = (float64(cellZ) + 0.1 + 0.8*random()) * plates.PlateSize
+	p.drift = 2 * math.Pi * random()
+	p.continental = random() < plates.LandFraction
+	last := [2]int{-1, -1}
+	if cells[0] > 0 {
+		last[0] = cells[0] - 1
+	}
+	if cells[1] > 0 {
+		last[1] = cells[1] - 1
+	}
+	if (wrappedX == 0 || wrappedX == last[0]) && (wrappedZ == 0 || wrappedZ == last[1]) {
+		p.continental = true
+	}
+	return p
+}
+
+// GetValue measures the distances from (x, z) to the nearby plates and
+// derives the coast and the boundary uplift from them. Both only depend on
+// the plates, not on which one is under (x, z), so they are continuous.
+func (plates *Plates) GetValue(x, y, z float64) float64 {
+	//the sources see the world coordinates, the plates a world stretched to a
+	//whole number of plates on wrapping axes
+	worldX, worldZ := x, z
+	cells := plates.wrapCells()
+	if cells[0] > 0 {
+		x *= float64(cells[0]) * plates.PlateSize / plates.Period[0]
+	}
+	if cells[1] > 0 {
+		z *= float64(cells[1]) * plates.PlateSize / plates.Period[1]
+	}
+	cellX := int(math.Floor(x / plates.PlateSize))
+	cellZ := int(math.Floor(z / plates.PlateSize))
+
+	neighbours := plates.neighbourhood(cellX, cellZ)
+	var squared [25]float64
+	nearest := 0
+	for i := range neighbours {
+		dx, dz := x-neighbours[i].site[0], z-neighbours[i].site[1]
+		squared[i] = dx*dx + dz*dz
+		if squared[i] < squared[nearest] {
+			nearest = i
+		}
+	}
+
+	//distance to the plates of the 3x3 cells around, 0 inside, clamped to
+	//half a plate size, the outer ring only bounds their cells
+	var distances [25]float64
+	limit := plates.PlateSize / 2
+	toLand, toOcean := limit, limit
+	for i := range neighbours {
+		distances[i] = limit
+		if i%5 == 0 || i%5 == 4 || i/5 == 0 || i/5 == 4 {
+			continue
+		}
+		//the bisector with the nearest plate alone is at least that far
+		if (math.Sqrt(squared[i])-math.Sqrt(squared[nearest]))/2 >= limit {
+			continue
+		}
+		distances[i] = math.Min(limit, neighbours.outside(i, x, z, &squared))
+		if neighbours[i].continental {
+			toLand = math.Min(toLand, distances[i])
+		} else {
+			toOcean = math.Min(toOcean, distances[i])
+		}
+	}
+
+	//signed distance to the coast, positive inland
+	shore := toOcean - toLand
+	if plates.Coast != nil {
+		shore += plates.CoastNoise * plates.Coast.GetValue(worldX, y, worldZ)
+	}
+
+	var height float64
+	if shore >= 0 {
+		land := plates.Land.GetValue(worldX, y, worldZ)
+		height = SeaLevel + (land-SeaLevel)*smoothstep(0, plates.CoastWidth, shore)
+	} else if -shore < plates.ShelfWidth {
+		height = SeaLevel - plates.ShelfDepth*(-shore/plates.ShelfWidth)
+	} else {
+		slope := smoothstep(0, plates.SlopeWidth, -shore-plates.ShelfWidth)
+		height = SeaLevel - plates.ShelfDepth - (plates.OceanDepth-plates.ShelfDepth)*slope
+	}
+
+	//every pair of plates close enough contributes along their boundary
+	reach := 3 * plates.UpliftWidth
+	for i := range neighbours {
+		if distances[i] > reach {
+			continue
+		}
+		for j := i + 1; j < len(neighbours); j++ {
+			if distances[j] > reach {
+				continue
+			}
+			a, b := neighbours[i], neighbours[j]
+			nx, nz := b.site[0]-a.site[0], b.site[1]-a.site[1]
+			length := math.Sqrt(nx*nx + nz*nz)
+			nx, nz = nx/length, nz/length
+			midX, midZ := (a.site[0]+b.site[0])/2, (a.site[1]+b.site[1])/2
+			boundary := math.Max(math.Abs((x-midX)*nx+(z-midZ)*nz), math.Max(distances[i], distances[j]))
+			falloff := math.Exp(-(boundary * boundary) / (plates.UpliftWidth * plates.UpliftWidth))
+			//closing speed, -1..1
+			convergence := ((math.Cos(a.drift)-math.Cos(b.drift))*nx + (math.Sin(a.drift)-math.Sin(b.drift))*nz) / 2
+			if convergence > 0 {
+				height += plates.Uplift * convergence * falloff
+			} else if !a.continental && !b.continental {
+				height += 0.3 * plates.Uplift * -convergence * falloff
+			}
+		}
+	}
+	return height
+}
+
+type plateNeighbours [25]plate
+
+type cachedNeighbours struct {
+	cell       [2]int
+	neighbours plateNeighbours
+}
+
+// neighbourhood returns the plates of the 5x5 cells around a cell. Sites are
+// jittered inside their cell, two cells around cover every neighbour. They
+// are kept in a slot picked by the cell, read and replaced without locking:
+// workers sampling different cells that share a slot only recompute them.
+func (plates *Plates) neighbourhood(cellX, cellZ int) *plateNeighbours {
+	cell := [2]int{cellX, cellZ}
+	slot := &plates.cells[mix64(uint64(int64(cellX))*0x9e3779b97f4a7c15^uint64(int64(cellZ)))%plateCacheSlots]
+	if cached, ok := slot.Load().(*cachedNeighbours); ok && cached.cell == cell {
+		return &cached.neighbours
+	}
+	cached := &cachedNeighbours{cell: cell}
+	for i := range cached.neighbours {
+		cached.neighbours[i] = plates.plateAt(cellX+i%5-2, cellZ+i/5-2)
+	}
+	slot.Store(cached)
+	return &cached.neighbours
+}
+
+// outside returns how far (x, z) is outside the Voronoi cell of plate i, the
+// largest distance past one of its bisectors. Only the plates closer than i
+// to (x, z), by their squared distances, put it past a bisector.
+func (neighbours *plateNeighbours) outside(i int, x, z float64, squared *[25]float64) float64 {
+	own := neighbours[i]
+	distance := 0.0
+	for j, other := range neighbours {
+		if squared[j] >= squared[i] {
+			continue
+		}
+		nx, nz := other.site[0]-own.site[0], other.site[1]-own.site[1]
+		length := math.Sqrt(nx*nx + nz*nz)
+		midX, midZ := (own.site[0]+other.site[0])/2, (own.site[1]+other.site[1])/2
+		if d := ((x-midX)*nx + (z-midZ)*nz) / length; d > distance {
+			distance = d
+		}
+	}
+	return distance
+}
+
+func (plates *Plates) GetSourceModule(index int) noiselib.Module {
+	if index == 1 {
+		return plates.Coast
+	}
+	return plates.Land
+}
+
+func (plates *Plates) SetSourceModule(index int, sourceModule noiselib.Module) {
+	if index == 1 {
+		plates.Coast = sourceModule
+	} else {
+		plates.Land = sourceModule
+	}
+}
+
+func (plates *Plates) SourceModuleCount() int {
+	return 2
+}
+
+func smoothstep(edge0, edge1, x float64) float64 {
+	t := math.Max(0, math.Min(1, (x-edge0)/(edge1-edge0)))
+	return t * t * (3 - 2*t)
+}
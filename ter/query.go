@@ -0,0 +1,100 @@
+package ter
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Terrain queries at any world (x, z). Heights are in heightmap units and
+// grow upward like Chunk.Map, while Y values, normals and slopes are in the
+// rendered space where FillModelData puts the ground at Y = -2*height.
+// Loaded chunks are interpolated, anywhere else the terrain noise is sampled
+// directly, without erosion or rivers. Queries read HeightMap.Chunks, so they
+// belong to the goroutine running the program loop.
+
+// queryChunk returns the loaded chunk under (x, z) and the position in its
+// grid, in points.
+func (heightMap *HeightMap) queryChunk(x, z float64) (*Chunk, float64, float64) {
+	worldSize := float64(heightMap.ChunkWorldSize)
+	position := [2]int{int(math.Floor(x / worldSize)), int(math.Floor(z / worldSize))}
+	chunk := heightMap.Chunks[heightMap.WrapChunk(position)]
+	if chunk == nil || !chunk.Loaded || chunk.Map == nil {
+		return nil, 0, 0
+	}
+	scale := float64(chunk.NBPoints) / worldSize
+	return chunk, (x - float64(position[0])*worldSize) * scale, (z - float64(position[1])*worldSize) * scale
+}
+
+// sampleChunk bilinearly interpolates one of the chunk maps.
+func sampleChunk(chunk *Chunk, field []float64, gridX, gridZ float64) float64 {
+	cellX := minInt(int(gridX), int(chunk.NBPoints)-1)
+	cellZ := minInt(int(gridZ), int(chunk.NBPoints)-1)
+	return bilinear(field, int(chunk.NBPoints)+1, cellX, cellZ, gridX-float64(cellX), gridZ-float64(cellZ))
+}
+
+// sampleLake interpolates the lake surface, NoLake unless the four points
+// around are under the lake.
+func sampleLake(chunk *Chunk, gridX, gridZ float64) float64 {
+	cellX := minInt(int(gridX), int(chunk.NBPoints)-1)
+	cellZ := minInt(int(gridZ), int(chunk.NBPoints)-1)
+	i := cellX + cellZ*(int(chunk.NBPoints)+1)
+	for _, corner := range [4]int{i, i + 1, i + int(chunk.NBPoints) + 1, i + int(chunk.NBPoints) + 2} {
+		if chunk.LakeMap[corner] == NoLake {
+			return NoLake
+		}
+	}
+	return sampleChunk(chunk, chunk.LakeMap, gridX, gridZ)
+}
+
+// HeightAt returns the ground height.
+func (heightMap *HeightMap) HeightAt(x, z float64) float64 {
+	if chunk, gridX, gridZ := heightMap.queryChunk(x, z); chunk != nil {
+		return sampleChunk(chunk, chunk.Map, gridX, gridZ)
+	}
+	return heightMap.Terrain.GetValue(x, 0, z)
+}
+
+// WaterDepthAt returns the depth of the sea, river or lake water above the
+// ground, 0 on dry land.
+func (heightMap *HeightMap) WaterDepthAt(x, z float64) float64 {
+	height := heightMap.HeightAt(x, z)
+	depth := math.Max(0, SeaLevel-height)
+	if chunk, gridX, gridZ := heightMap.queryChunk(x, z); chunk != nil {
+		depth = math.Max(depth, sampleChunk(chunk, chunk.WaterMap, gridX, gridZ))
+	}
+	return depth
+}
+
+// SurfaceY returns the rendered Y of the ground, or of the water surface
+// of lakes, like CreateChunkPolyMesh draws them.
+func (heightMap *HeightMap) SurfaceY(x, z float64) float32 {
+	height := heightMap.HeightAt(x, z)
+	if chunk, gridX, gridZ := heightMap.queryChunk(x, z); chunk != nil {
+		height = math.Max(height, sampleLake(chunk, gridX, gridZ))
+	}
+	return float32(-2 * height)
+}
+
+// gradientAt returns the derivatives of the rendered Y along x and z, by
+// central differences over one grid step.
+func (heightMap *HeightMap) gradientAt(x, z float64) (float64, float64) {
+	step := float64(heightMap.ChunkWorldSize) / float64(heightMap.ChunkNBPoints)
+	dx := heightMap.HeightAt(x+step, z) - heightMap.HeightAt(x-step, z)
+	dz := heightMap.HeightAt(x, z+step) - heightMap.HeightAt(x, z-step)
+	return -2 * dx / (2 * step), -2 * dz / (2 * step)
+}
+
+// NormalAt returns the ground normal, pointing up (towards -Y) like the chunk
+// mesh normals.
+func (heightMap *HeightMap) NormalAt(x, z float64) mgl32.Vec3 {
+	dx, dz := heightMap.gradientAt(x, z)
+	return mgl32.Vec3{float32(dx), -1, float32(dz)}.Normalize()
+}
+
+// SlopeAt returns the angle between the ground and the horizontal, in
+// radians.
+func (heightMap *HeightMap) SlopeAt(x, z float64) float64 {
+	dx, dz := heightMap.gradientAt(x, z)
+	return math.Atan(math.Sqrt(dx*dx + dz*dz))
+}
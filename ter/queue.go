@@ -0,0 +1,175 @@
+package ter
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// LoadQueue hands the chunks to load to the workers, the nearest to the camera
+// first. Chunks ahead of the camera count as nearer, by up to ViewWeight of
+// their distance. Focus moves the camera: pending chunks are sorted again,
+// the ones past the load radius are dropped and the ones being generated there
+// are cancelled. Remeshing loaded chunks goes before loading and is never
+// dropped.
+type LoadQueue struct {
+	ViewWeight float64
+
+	heightMap *HeightMap
+	mutex     sync.Mutex
+	wake      *sync.Cond
+	pending   loadJobs
+	running   map[*Chunk]bool
+	cancelled []*Chunk //generation stopped, to reset on the main thread
+
+	camera    mgl32.Vec3
+	direction mgl32.Vec2
+	center    [2]int
+	radius    int
+}
+
+type loadJob struct {
+	chunk    *Chunk
+	priority float64
+}
+
+type loadJobs []loadJob
+
+func (jobs loadJobs) Len() int            { return len(jobs) }
+func (jobs loadJobs) Less(i, j int) bool  { return jobs[i].priority < jobs[j].priority }
+func (jobs loadJobs) Swap(i, j int)       { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs *loadJobs) Push(x interface{}) { *jobs = append(*jobs, x.(loadJob)) }
+func (jobs *loadJobs) Pop() interface{} {
+	old := *jobs
+	job := old[len(old)-1]
+	*jobs = old[:len(old)-1]
+	return job
+}
+
+func NewLoadQueue(heightMap *HeightMap) *LoadQueue {
+	queue := &LoadQueue{ViewWeight: 0.5, heightMap: heightMap, running: make(map[*Chunk]bool), radius: -1}
+	queue.wake = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// priority orders the jobs, lowest first. The caller holds the lock.
+func (queue *LoadQueue) priority(chunk *Chunk) float64 {
+	if chunk.Loaded {
+		return math.Inf(-1)
+	}
+	size := float64(chunk.WorldSize)
+	dx := (float64(chunk.DrawPosition[0])+0.5)*size - float64(queue.camera.X())
+	dz := (float64(chunk.DrawPosition[1])+0.5)*size - float64(queue.camera.Z())
+	distance := math.Hypot(dx, dz)
+	if distance == 0 || queue.direction.Len() == 0 {
+		return distance
+	}
+	facing := (dx*float64(queue.direction.X()) + dz*float64(queue.direction.Y())) / distance
+	return distance * (1 - queue.ViewWeight*facing)
+}
+
+// outside tells if a chunk to load is past the load radius. The caller holds
+// the lock.
+func (queue *LoadQueue) outside(chunk *Chunk) bool {
+	return !chunk.Loaded && queue.radius >= 0 && queue.heightMap.chunkDistance(chunk.Position, queue.center) > queue.radius*queue.radius
+}
+
+// Push adds a chunk to load, or to remesh when it is loaded.
+func (queue *LoadQueue) Push(chunk *Chunk) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	heap.Push(&queue.pending, loadJob{chunk, queue.priority(chunk)})
+	queue.wake.Signal()
+}
+
+// Focus moves the camera to position looking at front, with chunks loaded in
+// radius chunks around the chunk center. It returns the chunks that are no
+// longer loading, dropped from the queue or cancelled, back to unloaded: they
+// are submitted again once back in range. It runs on the main thread, like
+// every change of the chunk flags.
+func (queue *LoadQueue) Focus(position, front mgl32.Vec3, center [2]int, radius int) []*Chunk {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.camera, queue.center, queue.radius = position, center, radius
+	queue.direction = mgl32.Vec2{front.X(), front.Z()}
+	if queue.direction.Len() > 0 {
+		queue.direction = queue.direction.Normalize()
+	}
+
+	var stopped []*Chunk
+	kept := queue.pending[:0]
+	for _, job := range queue.pending {
+		if queue.outside(job.chunk) {
+			stopped = append(stopped, job.chunk)
+			continue
+		}
+		job.priority = queue.priority(job.chunk)
+		kept = append(kept, job)
+	}
+	queue.pending = kept
+	heap.Init(&queue.pending)
+
+	for chunk := range queue.running {
+		if queue.outside(chunk) {
+			atomic.StoreInt32(&chunk.AtomicCancelled, 1)
+		}
+	}
+	stopped = append(stopped, queue.cancelled...)
+	queue.cancelled = nil
+	for _, chunk := range stopped {
+		chunk.evict()
+	}
+	return stopped
+}
+
+// Reset drops the pending jobs, cancels the chunks being loaded and waits for
+// the running jobs to end, remeshes included, before the generator changes.
+// The chunks are left for HeightMap.Regenerate to reset.
+func (queue *LoadQueue) Reset() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.pending = queue.pending[:0]
+	for chunk := range queue.running {
+		if !chunk.Loaded {
+			atomic.StoreInt32(&chunk.AtomicCancelled, 1)
+		}
+	}
+	for len(queue.running) > 0 {
+		queue.wake.Wait()
+	}
+	queue.cancelled = nil
+}
+
+// next blocks until there is a job and starts it.
+func (queue *LoadQueue) next() *Chunk {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for queue.pending.Len() == 0 {
+		queue.wake.Wait()
+	}
+	chunk := heap.Pop(&queue.pending).(loadJob).chunk
+	queue.running[chunk] = true
+	return chunk
+}
+
+// finish ends a job, the chunk is ready for OpenGL unless it was cancelled.
+func (queue *LoadQueue) finish(chunk *Chunk) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.running, chunk)
+	//Reset may be waiting for the running jobs
+	queue.wake.Broadcast()
+	if chunk.Cancelled() {
+		queue.cancelled = append(queue.cancelled, chunk)
+		return
+	}
+	atomic.StoreInt32(&chunk.AtomicNeedOpenGLLoading, 1) //flag as loaded
+}
+
+// Cancelled tells the worker generating a chunk to stop, the camera moved away.
+func (chunk *Chunk) Cancelled() bool {
+	return atomic.LoadInt32(&chunk.AtomicCancelled) == 1
+}
@@ -0,0 +1,169 @@
+package ter
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// RayHit is where a ray meets the rendered ground.
+type RayHit struct {
+	Position mgl32.Vec3 //world space, as rendered
+	Distance float32
+	Height   float64 //heightmap units, see HeightAt
+	Chunk    [2]int
+	Biome    BiomeID
+}
+
+// seaY is where chunk.vert flattens everything under the sea.
+const seaY = 2.0
+
+// cornerY returns the rendered Y of a point of the global chunk grid, lakes
+// at their surface and the sea flat like the chunk shaders. Points on a chunk
+// edge are read from whichever of the two chunks is loaded.
+func (heightMap *HeightMap) cornerY(gridX, gridZ int) (float32, bool) {
+	y, ok := heightMap.groundY(gridX, gridZ)
+	if ok && y > -2*SeaLevel {
+		y = seaY
+	}
+	return y, ok
+}
+
+// groundY is cornerY without the sea.
+func (heightMap *HeightMap) groundY(gridX, gridZ int) (float32, bool) {
+	points := int(heightMap.ChunkNBPoints)
+	for _, dx := range [2]int{0, -1} {
+		for _, dz := range [2]int{0, -1} {
+			position := [2]int{floorDiv(gridX, points) + dx, floorDiv(gridZ, points) + dz}
+			localX := gridX - position[0]*points
+			localZ := gridZ - position[1]*points
+			if localX > points || localZ > points {
+				continue
+			}
+			chunk := heightMap.Chunks[heightMap.WrapChunk(position)]
+			if chunk == nil || !chunk.Loaded || chunk.Map == nil {
+				continue
+			}
+			if int(chunk.NBPoints) != points {
+				//voxel chunks keep their maps at another resolution
+				scale := float64(chunk.NBPoints) / float64(points)
+				return float32(-2 * sampleChunk(chunk, chunk.Map, float64(localX)*scale, float64(localZ)*scale)), true
+			}
+			i := localX + localZ*(points+1)
+			return float32(-2 * math.Max(chunk.Map[i], chunk.LakeMap[i])), true
+		}
+	}
+	return 0, false
+}
+
+// Raycast walks the grid cells under the ray (2D DDA over x,z) and tests the
+// two triangles of every loaded cell, as CreateChunkPolyMesh builds them.
+// direction must be normalized, cells of chunks that are not loaded are
+// crossed without a hit.
+func (heightMap *HeightMap) Raycast(origin mgl32.Vec3, direction mgl32.Vec3, maxDistance float32) (RayHit, bool) {
+	step := float64(heightMap.ChunkWorldSize) / float64(heightMap.ChunkNBPoints)
+	cellX := int(math.Floor(float64(origin.X()) / step))
+	cellZ := int(math.Floor(float64(origin.Z()) / step))
+
+	//distance along the ray to the next cell boundary, and between two
+	stepX, stepZ := 1, 1
+	nextX, nextZ := math.Inf(1), math.Inf(1)
+	deltaX, deltaZ := math.Inf(1), math.Inf(1)
+	if direction.X() != 0 {
+		deltaX = step / math.Abs(float64(direction.X()))
+		if direction.X() > 0 {
+			nextX = (float64(cellX+1)*step - float64(origin.X())) / float64(direction.X())
+		} else {
+			stepX = -1
+			nextX = (float64(cellX)*step - float64(origin.X())) / float64(direction.X())
+		}
+	}
+	if direction.Z() != 0 {
+		deltaZ = step / math.Abs(float64(direction.Z()))
+		if direction.Z() > 0 {
+			nextZ = (float64(cellZ+1)*step - float64(origin.Z())) / float64(direction.Z())
+		} else {
+			stepZ = -1
+			nextZ = (float64(cellZ)*step - float64(origin.Z())) / float64(direction.Z())
+		}
+	}
+
+	for {
+		if t, ok := heightMap.intersectCell(cellX, cellZ, step, origin, direction); ok && t <= maxDistance {
+			return heightMap.rayHit(origin.Add(direction.Mul(t)), t), true
+		}
+		//looking straight down or up, the ray never leaves its cell
+		if math.Min(nextX, nextZ) > float64(maxDistance) {
+			return RayHit{}, false
+		}
+		if nextX < nextZ {
+			cellX += stepX
+			nextX += deltaX
+		} else {
+			cellZ += stepZ
+			nextZ += deltaZ
+		}
+	}
+}
+
+func (heightMap *HeightMap) intersectCell(cellX, cellZ int, step float64, origin, direction mgl32.Vec3) (float32, bool) {
+	var corners [4]mgl32.Vec3
+	for i, corner := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		y, ok := heightMap.cornerY(cellX+corner[0], cellZ+corner[1])
+		if !ok {
+			return 0, false
+		}
+		corners[i] = mgl32.Vec3{float32(float64(cellX+corner[0]) * step), y, float32(float64(cellZ+corner[1]) * step)}
+	}
+
+	best, hit := float32(math.MaxFloat32), false
+	for _, tri := range [2][3]int{{0, 1, 2}, {1, 3, 2}} {
+		if t, ok := intersectTriangle(origin, direction, corners[tri[0]], corners[tri[1]], corners[tri[2]]); ok && t < best {
+			best, hit = t, true
+		}
+	}
+	return best, hit
+}
+
+// intersectTriangle is Möller-Trumbore, both faces count.
+func intersectTriangle(origin, direction, a, b, c mgl32.Vec3) (float32, bool) {
+	const epsilon = 1e-7
+	edge1 := b.Sub(a)
+	edge2 := c.Sub(a)
+	p := direction.Cross(edge2)
+	det := edge1.Dot(p)
+	if det > -epsilon && det < epsilon {
+		return 0, false
+	}
+	inverse := 1 / det
+	s := origin.Sub(a)
+	u := s.Dot(p) * inverse
+	if u < 0 || u > 1 {
+		return 0, false
+	}
+	q := s.Cross(edge1)
+	v := direction.Dot(q) * inverse
+	if v < 0 || u+v > 1 {
+		return 0, false
+	}
+	t := edge2.Dot(q) * inverse
+	return t, t >= 0
+}
+
+func (heightMap *HeightMap) rayHit(position mgl32.Vec3, distance float32) RayHit {
+	hit := RayHit{
+		Position: position,
+		Distance: distance,
+		Height:   heightMap.HeightAt(float64(position.X()), float64(position.Z())),
+	}
+	hit.Chunk = heightMap.WrapChunk([2]int{
+		int(math.Floor(float64(position.X()) / float64(heightMap.ChunkWorldSize))),
+		int(math.Floor(float64(position.Z()) / float64(heightMap.ChunkWorldSize))),
+	})
+	if chunk, gridX, gridZ := heightMap.queryChunk(float64(position.X()), float64(position.Z())); chunk != nil && chunk.BiomeMap != nil {
+		x := minInt(int(gridX+0.5), int(chunk.NBPoints))
+		z := minInt(int(gridZ+0.5), int(chunk.NBPoints))
+		hit.Biome = chunk.BiomeMap[x+z*(int(chunk.NBPoints)+1)]
+	}
+	return hit
+}
@@ -0,0 +1,53 @@
+package ter
+
+// Chunk.Rim holds the heights of the points just past the edges of a chunk,
+// as its neighbours generate them before the edits, so normals along the
+// edges match on both sides. It is the rows z = -1 and z = NBPoints+1, then
+// the columns x = -1 and x = NBPoints+1, NBPoints+1 points each.
+
+// rimIndex returns where the point (x, z) past the edge of a chunk with
+// points cells a side sits in Chunk.Rim.
+func rimIndex(points, x, z int) int {
+	switch {
+	case z == -1:
+		return x
+	case z == points+1:
+		return points + 1 + x
+	case x == -1:
+		return 2*(points+1) + z
+	}
+	return 3*(points+1) + z
+}
+
+// splitPadded fills chunk.Map and chunk.Rim from a field grown by one point
+// on every side, (NBPoints+3)^2 values row major in z.
+func splitPadded(chunk *Chunk, field []float64) {
+	points := int(chunk.NBPoints)
+	size := points + 3
+	chunk.Rim = make([]float64, 4*(points+1))
+	for x := -1; x <= points+1; x++ {
+		for z := -1; z <= points+1; z++ {
+			height := field[(x+1)+(z+1)*size]
+			switch {
+			case x >= 0 && x <= points && z >= 0 && z <= points:
+				chunk.Map[x+z*(points+1)] = height
+			case (x >= 0 && x <= points) || (z >= 0 && z <= points):
+				chunk.Rim[rimIndex(points, x, z)] = height
+			}
+		}
+	}
+}
+
+// heightAround returns the height of the point (x, z) of a chunk or of its
+// rim with the current edits of the neighbour, the edge height without a rim.
+func (chunk *Chunk) heightAround(heightMap *HeightMap, x, z int) float64 {
+	points := int(chunk.NBPoints)
+	if x >= 0 && x <= points && z >= 0 && z <= points {
+		return chunk.Map[x+z*(points+1)]
+	}
+	if chunk.Rim == nil {
+		return chunk.Map[minInt(maxInt(x, 0), points)+minInt(maxInt(z, 0), points)*(points+1)]
+	}
+	gridX, gridZ := chunk.Position[0]*points+x, chunk.Position[1]*points+z
+	return chunk.Rim[rimIndex(points, x, z)] + heightMap.Edits.deltaAt(heightMap, float64(gridX), float64(gridZ))
+}
@@ -0,0 +1,496 @@
+package ter
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+
+	"../gfx"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// RoadParams configures the road network. Every region of RegionChunks
+// chunks gets a point of interest, linked to the ones of the next regions
+// along x and z by the cheapest path over the terrain noise, on a lattice of
+// Cell world units. Like the rivers a road only depends on the regions it
+// links, so every chunk reads the same road. Distances are in world units,
+// heights in heightmap units.
+type RoadParams struct {
+	RegionChunks int
+	Cell         float64
+	Margin       float64 //how far a path may stray from the box of its ends
+	SlopeCost    float64 //extra cost of a step per squared slope
+	WaterCost    float64 //extra cost of a step in the sea, a river or a lake, per world unit
+	Width        float64
+	Blend        float64 //from the road edge to the untouched terrain
+	Corridor     float64 //vegetation is cleared this far from the middle of the road
+	Grade        int     //samples averaged along the road for its height
+	Lift         float64 //ribbon above the flattened ground
+}
+
+func DefaultRoadParams() *RoadParams {
+	return &RoadParams{
+		RegionChunks: 4,
+		Cell:         0.75,
+		Margin:       12,
+		SlopeCost:    100,
+		WaterCost:    40,
+		Width:        0.4,
+		Blend:        0.6,
+		Corridor:     0.8,
+		Grade:        9,
+		Lift:         0.02,
+	}
+}
+
+type roadCache struct {
+	mutex sync.Mutex
+	roads map[[3]int]*road
+}
+
+// road links the point of interest of a region to the next one along an
+// axis, points is empty when one of them is missing.
+type road struct {
+	done     chan struct{}
+	points   [][3]float64 //x, z and height, every half cell
+	min, max [2]float64
+}
+
+func newRoadCache() *roadCache {
+	return &roadCache{roads: make(map[[3]int]*road)}
+}
+
+// roadRegions returns the region size along each axis, and how many regions
+// a wrapping axis holds, 0 for an infinite axis.
+func (heightMap *HeightMap) roadRegions() ([2]float64, [2]int) {
+	var size [2]float64
+	var count [2]int
+	for axis := 0; axis < 2; axis++ {
+		size[axis] = float64(heightMap.Roads.RegionChunks) * float64(heightMap.ChunkWorldSize)
+		if heightMap.Wrap[axis] > 0 {
+			count[axis] = maxInt(1, heightMap.Wrap[axis]/heightMap.Roads.RegionChunks)
+			size[axis] = float64(heightMap.Wrap[axis]) * float64(heightMap.ChunkWorldSize) / float64(count[axis])
+		}
+	}
+	return size, count
+}
+
+// pointOfInterest returns the flattest dry spot among a few candidates of a
+// region, ok is false when they all are under water.
+func (heightMap *HeightMap) pointOfInterest(region [2]int) ([2]float64, bool) {
+	size, count := heightMap.roadRegions()
+	wrapped := region
+	for axis := range wrapped {
+		if count[axis] > 0 {
+			wrapped[axis] = region[axis] - floorDiv(region[axis], count[axis])*count[axis]
+		}
+	}
+	rng := ChunkRand(heightMap.Seed, wrapped, "roads")
+	d := heightMap.Roads.Cell
+	var best [2]float64
+	bestSlope := math.Inf(1)
+	for candidate := 0; candidate < 4; candidate++ {
+		x := (float64(region[0]) + 0.2 + 0.6*rng.Float64()) * size[0]
+		z := (float64(region[1]) + 0.2 + 0.6*rng.Float64()) * size[1]
+		if heightMap.Terrain.GetValue(x, 0, z) < SeaLevel+0.05 || heightMap.waterAt(x, z) {
+			continue
+		}
+		slope := math.Abs(heightMap.Terrain.GetValue(x+d, 0, z)-heightMap.Terrain.GetValue(x-d, 0, z)) +
+			math.Abs(heightMap.Terrain.GetValue(x, 0, z+d)-heightMap.Terrain.GetValue(x, 0, z-d))
+		if slope < bestSlope {
+			best, bestSlope = [2]float64{x, z}, slope
+		}
+	}
+	return best, !math.IsInf(bestSlope, 1)
+}
+
+// waterAt tells if the rivers or lakes cover (x, z), the sea is left to the
+// heights.
+func (heightMap *HeightMap) waterAt(x, z float64) bool {
+	if heightMap.Rivers == nil {
+		return false
+	}
+	spacing := heightMap.latticeSpacing()
+	return heightMap.latticeWater(int(math.Floor(x/spacing+0.5)), int(math.Floor(z/spacing+0.5)))
+}
+
+// road returns the road from a region to the next one along axis, solving
+// it on first use like drainageRegion.
+func (heightMap *HeightMap) road(region [2]int, axis int) *road {
+	key := [3]int{region[0], region[1], axis}
+	cache := heightMap.roads
+	cache.mutex.Lock()
+	r, ok := cache.roads[key]
+	if !ok {
+		r = &road{done: make(chan struct{})}
+		cache.roads[key] = r
+	}
+	cache.mutex.Unlock()
+
+	if ok {
+		<-r.done
+		return r
+	}
+	heightMap.solveRoad(region, axis, r)
+	close(r.done)
+	return r
+}
+
+// solveRoad runs A* between the two points of interest, then smooths the
+// path into a quadratic B-spline (Chaikin corner cutting) and grades it.
+func (heightMap *HeightMap) solveRoad(region [2]int, axis int, r *road) {
+	params := heightMap.Roads
+	_, count := heightMap.roadRegions()
+	if count[axis] == 1 {
+		//the region would link to itself
+		return
+	}
+	next := region
+	next[axis]++
+	from, ok := heightMap.pointOfInterest(region)
+	if !ok {
+		return
+	}
+	to, ok := heightMap.pointOfInterest(next)
+	if !ok {
+		return
+	}
+
+	originX := math.Min(from[0], to[0]) - params.Margin
+	originZ := math.Min(from[1], to[1]) - params.Margin
+	sizeX := int(math.Ceil((math.Abs(to[0]-from[0])+2*params.Margin)/params.Cell)) + 1
+	sizeZ := int(math.Ceil((math.Abs(to[1]-from[1])+2*params.Margin)/params.Cell)) + 1
+	heights := make([]float64, sizeX*sizeZ)
+	water := make([]bool, sizeX*sizeZ)
+	for x := 0; x < sizeX; x++ {
+		for z := 0; z < sizeZ; z++ {
+			posX, posZ := originX+float64(x)*params.Cell, originZ+float64(z)*params.Cell
+			heights[x+z*sizeX] = heightMap.Terrain.GetValue(posX, 0, posZ)
+			water[x+z*sizeX] = heights[x+z*sizeX] < SeaLevel || heightMap.waterAt(posX, posZ)
+		}
+	}
+
+	cell := func(p [2]float64) int {
+		x := minInt(sizeX-1, int(math.Floor((p[0]-originX)/params.Cell+0.5)))
+		z := minInt(sizeZ-1, int(math.Floor((p[1]-originZ)/params.Cell+0.5)))
+		return x + z*sizeX
+	}
+	start, goal := cell(from), cell(to)
+	goalX, goalZ := float64(goal%sizeX), float64(goal/sizeX)
+
+	cost := make([]float64, len(heights))
+	previous := make([]int, len(heights))
+	for i := range cost {
+		cost[i] = math.Inf(1)
+		previous[i] = -1
+	}
+	cost[start] = 0
+	open := &floodQueue{{0, start}}
+	for open.Len() > 0 {
+		current := heap.Pop(open).(floodCell).index
+		if current == goal {
+			break
+		}
+		cx, cz := current%sizeX, current/sizeX
+		for _, neighbour := range drainageNeighbours {
+			nx, nz := cx+int(neighbour[0]), cz+int(neighbour[1])
+			if nx < 0 || nz < 0 || nx >= sizeX || nz >= sizeZ {
+				continue
+			}
+			n := nx + nz*sizeX
+			distance := neighbour[2] * params.Cell
+			slope := (heights[n] - heights[current]) / distance
+			step := distance * (1 + params.SlopeCost*slope*slope)
+			if water[n] {
+				step += params.WaterCost * distance
+			}
+			if cost[current]+step < cost[n] {
+				cost[n] = cost[current] + step
+				previous[n] = current
+				//straight line heuristic, a step never costs less than its length
+				heuristic := math.Hypot(float64(nx)-goalX, float64(nz)-goalZ) * params.Cell
+				heap.Push(open, floodCell{cost[n] + heuristic, n})
+			}
+		}
+	}
+	if previous[goal] == -1 && goal != start {
+		return
+	}
+
+	//goal to start, the ends are the points of interest themselves
+	path := [][2]float64{to}
+	for i := previous[goal]; i != -1 && i != start; i = previous[i] {
+		path = append(path, [2]float64{originX + float64(i%sizeX)*params.Cell, originZ + float64(i/sizeX)*params.Cell})
+	}
+	path = append(path, from)
+	for iteration := 0; iteration < 3; iteration++ {
+		path = chaikin(path)
+	}
+	path = resample(path, params.Cell/2)
+
+	grounds := make([]float64, len(path))
+	for i, p := range path {
+		grounds[i] = heightMap.Terrain.GetValue(p[0], 0, p[1])
+	}
+	r.min = [2]float64{math.Inf(1), math.Inf(1)}
+	r.max = [2]float64{math.Inf(-1), math.Inf(-1)}
+	for i, p := range path {
+		sum, samples := 0.0, 0
+		for j := maxInt(0, i-params.Grade/2); j <= minInt(len(path)-1, i+params.Grade/2); j++ {
+			sum += grounds[j]
+			samples++
+		}
+		//roads cross the sea on causeways
+		height := math.Max(sum/float64(samples), SeaLevel+0.02)
+		r.points = append(r.points, [3]float64{p[0], p[1], height})
+		r.min = [2]float64{math.Min(r.min[0], p[0]), math.Min(r.min[1], p[1])}
+		r.max = [2]float64{math.Max(r.max[0], p[0]), math.Max(r.max[1], p[1])}
+	}
+}
+
+// chaikin cuts the corners of a polyline, keeping its ends.
+func chaikin(points [][2]float64) [][2]float64 {
+	smooth := [][2]float64{points[0]}
+	for i := 0; i+1 < len(points); i++ {
+		a, b := points[i], points[i+1]
+		smooth = append(smooth,
+			[2]float64{0.75*a[0] + 0.25*b[0], 0.75*a[1] + 0.25*b[1]},
+			[2]float64{0.25*a[0] + 0.75*b[0], 0.25*a[1] + 0.75*b[1]})
+	}
+	return append(smooth, points[len(points)-1])
+}
+
+// resample returns points every spacing along a polyline, its ends included.
+func resample(points [][2]float64, spacing float64) [][2]float64 {
+	result := [][2]float64{points[0]}
+	travelled := 0.0
+	for i := 0; i+1 < len(points); i++ {
+		a, b := points[i], points[i+1]
+		length := math.Hypot(b[0]-a[0], b[1]-a[1])
+		for travelled+length >= spacing && length > 0 {
+			t := (spacing - travelled) / length
+			a = [2]float64{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+			length -= spacing - travelled
+			travelled = 0
+			result = append(result, a)
+		}
+		travelled += length
+	}
+	if travelled > spacing/4 {
+		result = append(result, points[len(points)-1])
+	} else {
+		result[len(result)-1] = points[len(points)-1]
+	}
+	return result
+}
+
+// roadsAround returns the roads passing within reach of a chunk.
+func (heightMap *HeightMap) roadsAround(position [2]int, reach float64) []*road {
+	size, _ := heightMap.roadRegions()
+	worldSize := float64(heightMap.ChunkWorldSize)
+	min := [2]float64{float64(position[0])*worldSize - reach, float64(position[1])*worldSize - reach}
+	max := [2]float64{min[0] + worldSize + 2*reach, min[1] + worldSize + 2*reach}
+
+	var roads []*road
+	//a road runs from its region to the next one, straying up to Margin from
+	//the box of its ends, so regions up to Margin away may hold it
+	margin := heightMap.Roads.Margin
+	for x := int(math.Floor((min[0]-margin)/size[0])) - 1; x <= int(math.Floor((max[0]+margin)/size[0])); x++ {
+		for z := int(math.Floor((min[1]-margin)/size[1])) - 1; z <= int(math.Floor((max[1]+margin)/size[1])); z++ {
+			for axis := 0; axis < 2; axis++ {
+				r := heightMap.road([2]int{x, z}, axis)
+				if len(r.points) == 0 || r.max[0] < min[0] || r.max[1] < min[1] || r.min[0] > max[0] || r.min[1] > max[1] {
+					continue
+				}
+				roads = append(roads, r)
+			}
+		}
+	}
+	return roads
+}
+
+// roadFootprint returns the distance from every point of a chunk grid grown
+// by pad points on every side to the middle of the nearest road, and the road
+// height there. Points further than reach keep an infinite distance.
+func roadFootprint(chunk *Chunk, roads []*road, reach float64, pad int) ([]float64, []float64) {
+	points := int(chunk.NBPoints) + 1 + 2*pad
+	distances := make([]float64, points*points)
+	heights := make([]float64, points*points)
+	for i := range distances {
+		distances[i] = math.Inf(1)
+	}
+	step := float64(chunk.WorldSize) / float64(chunk.NBPoints)
+	originX := float64(chunk.Position[0])*float64(chunk.WorldSize) - float64(pad)*step
+	originZ := float64(chunk.Position[1])*float64(chunk.WorldSize) - float64(pad)*step
+
+	for _, r := range roads {
+		for s := 0; s+1 < len(r.points); s++ {
+			a, b := r.points[s], r.points[s+1]
+			fromX := maxInt(0, int(math.Ceil((math.Min(a[0], b[0])-reach-originX)/step)))
+			toX := minInt(points-1, int(math.Floor((math.Max(a[0], b[0])+reach-originX)/step)))
+			fromZ := maxInt(0, int(math.Ceil((math.Min(a[1], b[1])-reach-originZ)/step)))
+			toZ := minInt(points-1, int(math.Floor((math.Max(a[1], b[1])+reach-originZ)/step)))
+			dx, dz := b[0]-a[0], b[1]-a[1]
+			squared := dx*dx + dz*dz
+			for x := fromX; x <= toX; x++ {
+				for z := fromZ; z <= toZ; z++ {
+					px, pz := originX+float64(x)*step-a[0], originZ+float64(z)*step-a[1]
+					t := 0.0
+					if squared > 0 {
+						t = math.Max(0, math.Min(1, (px*dx+pz*dz)/squared))
+					}
+					distance := math.Hypot(px-t*dx, pz-t*dz)
+					if i := x + z*points; distance < distances[i] && distance <= reach {
+						distances[i] = distance
+						heights[i] = a[2] + t*(b[2]-a[2])
+					}
+				}
+			}
+		}
+	}
+	return distances, heights
+}
+
+// applyRoads flattens chunk.Map and chunk.Rim under the roads, blending into
+// the terrain around, and keeps the road itself dry.
+func applyRoads(chunk *Chunk, heightMap *HeightMap) {
+	params := heightMap.Roads
+	half := params.Width / 2
+	step := float64(chunk.WorldSize) / float64(chunk.NBPoints)
+	roads := heightMap.roadsAround(chunk.Position, half+params.Blend+step)
+	if len(roads) == 0 {
+		return
+	}
+	distances, heights := roadFootprint(chunk, roads, half+params.Blend, 1)
+	points := int(chunk.NBPoints)
+	for x := -1; x <= points+1; x++ {
+		for z := -1; z <= points+1; z++ {
+			distance := distances[(x+1)+(z+1)*(points+3)]
+			if math.IsInf(distance, 1) {
+				continue
+			}
+			weight := 1 - smoothstep(half, half+params.Blend, distance)
+			height := heights[(x+1)+(z+1)*(points+3)]
+			inX, inZ := x >= 0 && x <= points, z >= 0 && z <= points
+			switch {
+			case inX && inZ:
+				i := x + z*(points+1)
+				chunk.Map[i] += (height - chunk.Map[i]) * weight
+				if distance < half {
+					chunk.WaterMap[i] = 0
+					chunk.LakeMap[i] = NoLake
+				}
+			case (inX || inZ) && chunk.Rim != nil:
+				i := rimIndex(points, x, z)
+				chunk.Rim[i] += (height - chunk.Rim[i]) * weight
+			}
+		}
+	}
+}
+
+// clearRoadCorridor drops the grass and trees growing within Corridor of a
+// road.
+func clearRoadCorridor(chunk *Chunk, heightMap *HeightMap) {
+	if heightMap.Roads == nil {
+		return
+	}
+	roads := heightMap.roadsAround(chunk.Position, heightMap.Roads.Corridor)
+	if len(roads) == 0 {
+		return
+	}
+	distances, _ := roadFootprint(chunk, roads, heightMap.Roads.Corridor, 0)
+	points := int(chunk.NBPoints) + 1
+	step := float32(chunk.WorldSize) / float32(chunk.NBPoints)
+	originX := float32(chunk.Position[0]) * float32(chunk.WorldSize)
+	originZ := float32(chunk.Position[1]) * float32(chunk.WorldSize)
+	//vegetation grows on the grid points, the translation gives them back
+	outside := func(transform mgl32.Mat4) bool {
+		x := minInt(points-1, maxInt(0, int(math.Floor(float64((transform[12]-originX)/step)+0.5))))
+		z := minInt(points-1, maxInt(0, int(math.Floor(float64((transform[14]-originZ)/step)+0.5))))
+		return math.IsInf(distances[x+z*points], 1)
+	}
+
+	grass := chunk.GrassTransforms[:0]
+	for _, transform := range chunk.GrassTransforms {
+		if outside(transform) {
+			grass = append(grass, transform)
+		}
+	}
+	chunk.GrassTransforms = grass
+	trees := chunk.TreesTransforms[:0]
+	biomes := chunk.TreesBiome[:0]
+	for i, transform := range chunk.TreesTransforms {
+		if outside(transform) {
+			trees = append(trees, transform)
+			biomes = append(biomes, chunk.TreesBiome[i])
+		}
+	}
+	chunk.TreesTransforms, chunk.TreesBiome = trees, biomes
+}
+
+// CreateRoadMesh builds the ribbons of the road segments starting in a chunk,
+// in chunk space like CreateChunkPolyMesh. Ribbons lie Lift above the final
+// chunk.Map, so they follow the sculpted ground too.
+func CreateRoadMesh(chunk *Chunk, textureContainer *ChunkTextureContainer, heightMap *HeightMap) gfx.Mesh {
+	mesh := gfx.Mesh{TextureID: textureContainer.RoadID}
+	params := heightMap.Roads
+	worldSize := float64(chunk.WorldSize)
+	step := worldSize / float64(chunk.NBPoints)
+	originX := float64(chunk.Position[0]) * worldSize
+	originZ := float64(chunk.Position[1]) * worldSize
+	inside := func(p [3]float64) bool {
+		return p[0] >= originX && p[0] < originX+worldSize && p[1] >= originZ && p[1] < originZ+worldSize
+	}
+	//the ground under the ribbon, past the chunk it is what applyRoads and
+	//the edits leave in the neighbour: the grade moved by the edits
+	ground := func(x, z, grade float64) float64 {
+		gridX, gridZ := (x-originX)/step, (z-originZ)/step
+		if gridX >= 0 && gridZ >= 0 && gridX <= float64(chunk.NBPoints) && gridZ <= float64(chunk.NBPoints) {
+			return sampleChunk(chunk, chunk.Map, gridX, gridZ)
+		}
+		return grade + heightMap.Edits.deltaAt(heightMap, x/step, z/step)
+	}
+
+	for _, r := range heightMap.roadsAround(chunk.Position, params.Cell) {
+		//the sides of the ribbon at point i, across the mean direction there
+		side := func(i int) (mgl32.Vec3, mgl32.Vec3) {
+			a, b := r.points[maxInt(0, i-1)], r.points[minInt(len(r.points)-1, i+1)]
+			dx, dz := b[0]-a[0], b[1]-a[1]
+			length := math.Hypot(dx, dz)
+			nx, nz := -dz/length*params.Width/2, dx/length*params.Width/2
+			p := r.points[i]
+			left := float32(-(ground(p[0]+nx, p[1]+nz, p[2]) + params.Lift))
+			right := float32(-(ground(p[0]-nx, p[1]-nz, p[2]) + params.Lift))
+			return mgl32.Vec3{float32(p[0] + nx - originX), left, float32(p[1] + nz - originZ)},
+				mgl32.Vec3{float32(p[0] - nx - originX), right, float32(p[1] - nz - originZ)}
+		}
+		travelled := 0.0
+		for i := 0; i+1 < len(r.points); i++ {
+			length := math.Hypot(r.points[i+1][0]-r.points[i][0], r.points[i+1][1]-r.points[i][1])
+			if !inside(r.points[i]) {
+				travelled += length
+				continue
+			}
+			left0, right0 := side(i)
+			left1, right1 := side(i + 1)
+			//the texture repeats every road width
+			v0 := float32(travelled / params.Width)
+			v1 := float32((travelled + length) / params.Width)
+			travelled += length
+
+			first := uint32(len(mesh.Vertices))
+			normal := mgl32.Vec3{0, -1, 0}
+			color := mgl32.Vec4{0.5, 0.45, 0.4, 0}
+			mesh.Vertices = append(mesh.Vertices,
+				gfx.Vertex{Position: left0, Normal: normal, Color: color, Texture: mgl32.Vec2{0, v0}},
+				gfx.Vertex{Position: right0, Normal: normal, Color: color, Texture: mgl32.Vec2{1, v0}},
+				gfx.Vertex{Position: left1, Normal: normal, Color: color, Texture: mgl32.Vec2{0, v1}},
+				gfx.Vertex{Position: right1, Normal: normal, Color: color, Texture: mgl32.Vec2{1, v1}})
+			mesh.Connectivity = append(mesh.Connectivity,
+				gfx.TriangleConnectivity{first, first + 1, first + 2},
+				gfx.TriangleConnectivity{first + 1, first + 3, first + 2})
+		}
+	}
+	return mesh
+}
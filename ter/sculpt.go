@@ -0,0 +1,288 @@
+package ter
+
+import (
+	"math"
+
+	"../gfx"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+type BrushTool int
+
+const (
+	BrushRaise BrushTool = iota
+	BrushLower
+	BrushFlatten
+	BrushSmooth
+	BrushNoise
+)
+
+var BrushToolNames = [...]string{"raise", "lower", "flatten", "smooth", "noise"}
+
+// Brush sculpts the terrain around a point. Strength is in heightmap units
+// per second for raise, lower and noise, and the share of the way to the
+// target per second for flatten and smooth.
+type Brush struct {
+	Tool     BrushTool
+	Radius   float64 //world units
+	Strength float64
+	Falloff  float64 //0 is a hard edge, 1 fades from the center
+}
+
+func DefaultBrush() *Brush {
+	return &Brush{Tool: BrushRaise, Radius: 1.5, Strength: 0.5, Falloff: 0.7}
+}
+
+// weight returns the strength of the brush at distance/Radius t.
+func (brush *Brush) weight(t float64) float64 {
+	inner := 1 - brush.Falloff
+	if t <= inner {
+		return 1
+	}
+	return 1 - smoothstep(inner, 1, t)
+}
+
+// gridChunk returns a loaded heightfield chunk holding a point of the global
+// chunk grid, and the point in its grid. Points on a chunk edge are read from
+// whichever chunk is loaded.
+func (heightMap *HeightMap) gridChunk(gridX, gridZ int) (*Chunk, int, int) {
+	points := int(heightMap.ChunkNBPoints)
+	for _, dx := range [2]int{0, -1} {
+		for _, dz := range [2]int{0, -1} {
+			position := [2]int{floorDiv(gridX, points) + dx, floorDiv(gridZ, points) + dz}
+			localX := gridX - position[0]*points
+			localZ := gridZ - position[1]*points
+			if localX > points || localZ > points {
+				continue
+			}
+			chunk := heightMap.Chunks[heightMap.WrapChunk(position)]
+			if chunk == nil || !chunk.Loaded || chunk.Map == nil {
+				continue
+			}
+			return chunk, localX, localZ
+		}
+	}
+	return nil, 0, 0
+}
+
+// sculptedHeight returns the height of a grid point with every edit made so
+// far, the chunk Map may not have been remeshed with the latest ones yet. The
+// caller holds the edits lock.
+func (heightMap *HeightMap) sculptedHeight(gridX, gridZ int) (float64, bool) {
+	chunk, localX, localZ := heightMap.gridChunk(gridX, gridZ)
+	if chunk == nil {
+		return 0, false
+	}
+	i := localX + localZ*(int(chunk.NBPoints)+1)
+	height := chunk.Map[i]
+	if chunk.Edits != nil {
+		height -= chunk.Edits[i]
+	}
+	if tile := heightMap.Edits.Tiles[chunk.Position]; tile != nil {
+		height += tile[i]
+	}
+	return height, true
+}
+
+// Sculpt applies the brush at world (x, z) for dt seconds to the edit layer
+// and returns the chunks to remesh. Only the points of loaded chunks are
+// sculpted, voxel terrain is left alone. It reads HeightMap.Chunks, so it
+// belongs to the goroutine running the program loop.
+func (heightMap *HeightMap) Sculpt(brush *Brush, x, z float64, dt float64) [][2]int {
+	if heightMap.Edits == nil || heightMap.Volume != nil || brush.Radius <= 0 {
+		return nil
+	}
+	edits := heightMap.Edits
+	edits.mutex.Lock()
+	defer edits.mutex.Unlock()
+
+	step := float64(heightMap.ChunkWorldSize) / float64(heightMap.ChunkNBPoints)
+	centerX, centerZ := x/step, z/step
+	radius := brush.Radius / step
+
+	target, ok := heightMap.sculptedHeight(int(math.Floor(centerX+0.5)), int(math.Floor(centerZ+0.5)))
+	if !ok {
+		return nil
+	}
+	noiseSeed := uint64(DeriveSeed(heightMap.Seed, "brush"))
+
+	//every delta is computed from the heights before this step
+	type edit struct {
+		gridX, gridZ int
+		delta        float64
+	}
+	var changes []edit
+	for gridX := int(math.Ceil(centerX - radius)); gridX <= int(math.Floor(centerX+radius)); gridX++ {
+		for gridZ := int(math.Ceil(centerZ - radius)); gridZ <= int(math.Floor(centerZ+radius)); gridZ++ {
+			distance := math.Hypot(float64(gridX)-centerX, float64(gridZ)-centerZ)
+			if distance > radius {
+				continue
+			}
+			height, ok := heightMap.sculptedHeight(gridX, gridZ)
+			if !ok {
+				continue
+			}
+			amount := brush.Strength * dt * brush.weight(distance/radius)
+			var delta float64
+			switch brush.Tool {
+			case BrushRaise:
+				delta = amount
+			case BrushLower:
+				delta = -amount
+			case BrushFlatten:
+				delta = (target - height) * math.Min(1, amount)
+			case BrushSmooth:
+				sum, count := 0.0, 0
+				for _, offset := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+					if neighbour, ok := heightMap.sculptedHeight(gridX+offset[0], gridZ+offset[1]); ok {
+						sum += neighbour
+						count++
+					}
+				}
+				if count > 0 {
+					delta = (sum/float64(count) - height) * math.Min(1, amount)
+				}
+			case BrushNoise:
+				//about two bumps across the brush
+				scale := 2 / brush.Radius
+				delta = amount * gradientNoise4(float64(gridX)*step*scale, float64(gridZ)*step*scale, 0, 0, noiseSeed)
+			}
+			if delta != 0 {
+				changes = append(changes, edit{gridX, gridZ, delta})
+			}
+		}
+	}
+
+	touched := make(map[[2]int]bool)
+	for _, change := range changes {
+		edits.add(heightMap, change.gridX, change.gridZ, change.delta, touched)
+	}
+	var positions [][2]int
+	for position := range touched {
+		positions = append(positions, position)
+	}
+	return positions
+}
+
+// Plant plants a tree at the point nearest to world (x, z), or removes the
+// one of the tree grid there, and returns the change to push in the history,
+// nil when there is nothing to change. Redo applies it. Points on chunk edges
+// are edited in every chunk sharing them, like the sculpted heights.
+func (heightMap *HeightMap) Plant(x, z float64, place bool) *PlantChange {
+	if heightMap.Edits == nil || heightMap.Volume != nil {
+		return nil
+	}
+	points := int(heightMap.ChunkNBPoints)
+	step := float64(heightMap.ChunkWorldSize) / float64(points)
+	//trees are only generated every points/32 points
+	snap := 1
+	if !place {
+		snap = maxInt(1, points/32)
+	}
+	gridX := int(math.Floor(x/(step*float64(snap))+0.5)) * snap
+	gridZ := int(math.Floor(z/(step*float64(snap))+0.5)) * snap
+
+	change := &PlantChange{Edits: heightMap.Edits, After: PlantRemoved}
+	if place {
+		change.After = PlantPlaced
+	}
+	for _, dx := range [2]int{0, -1} {
+		for _, dz := range [2]int{0, -1} {
+			position := [2]int{floorDiv(gridX, points) + dx, floorDiv(gridZ, points) + dz}
+			localX := gridX - position[0]*points
+			localZ := gridZ - position[1]*points
+			if localX > points || localZ > points {
+				continue
+			}
+			position = heightMap.WrapChunk(position)
+			index := int32(localX + localZ*(points+1))
+			before := heightMap.Edits.ChunkPlants(position)[index]
+			after := change.After
+			if !place && before == PlantPlaced {
+				after = PlantGenerated
+			}
+			if after != before {
+				change.Points = append(change.Points, PlantPoint{position, index, before, after})
+			}
+		}
+	}
+	if len(change.Points) == 0 {
+		return nil
+	}
+	return change
+}
+
+// ChunkRemesh is a loaded chunk rebuilt with new edits, waiting for the
+// program loop to swap it in and upload the model.
+type ChunkRemesh struct {
+	Model           *gfx.Model
+	LODModels       []*gfx.Model
+	RoadModel       *gfx.Model
+	Map             []float64
+	NormalY         []float64
+	BiomeMap        []BiomeID
+	Edits           []float64
+	GrassTransforms []mgl32.Mat4
+	TreesTransforms []mgl32.Mat4
+	TreesBiome      []BiomeID
+	HeightRange     [2]float64
+}
+
+// RemeshChunk rebuilds a loaded chunk with the current edits into
+// chunk.Remesh. The chunk is still drawn meanwhile, so only copies are
+// written. Water and lakes keep their generated course.
+func RemeshChunk(chunk *Chunk, heightMap *HeightMap, textureContainer *ChunkTextureContainer) {
+	edited := Chunk{NBPoints: chunk.NBPoints, WorldSize: chunk.WorldSize, Position: chunk.Position, WaterMap: chunk.WaterMap, LakeMap: chunk.LakeMap, Rim: chunk.Rim}
+	edited.Map = append([]float64(nil), chunk.Map...)
+	edited.Edits = heightMap.Edits.Tile(chunk.Position)
+	for i := range edited.Map {
+		if chunk.Edits != nil {
+			edited.Map[i] -= chunk.Edits[i]
+		}
+		if edited.Edits != nil {
+			edited.Map[i] += edited.Edits[i]
+		}
+	}
+	edited.NormalY = make([]float64, len(chunk.NormalY))
+	fillBiomeMap(&edited, heightMap)
+
+	mesh := CreateChunkPolyMesh(edited, textureContainer, heightMap)
+	fillHeightRange(&edited)
+	remesh := &ChunkRemesh{Map: edited.Map, NormalY: edited.NormalY, BiomeMap: edited.BiomeMap, Edits: edited.Edits, HeightRange: edited.HeightRange}
+	if heightMap.LOD != nil {
+		remesh.LODModels = buildLODModels(mesh, &edited, heightMap.LOD)
+		remesh.Model = remesh.LODModels[0]
+	} else {
+		remesh.Model = new(gfx.Model)
+		remesh.Model.LoadingData = gfx.FillModelData(&mesh)
+	}
+	edited.GrassTransforms = getGrassTransforms(&edited, heightMap.Seed)
+	edited.TreesTransforms, edited.TreesBiome = getTreesTransforms(&edited, heightMap.Seed, heightMap.Edits.ChunkPlants(chunk.Position))
+	clearRoadCorridor(&edited, heightMap)
+	remesh.GrassTransforms, remesh.TreesTransforms, remesh.TreesBiome = edited.GrassTransforms, edited.TreesTransforms, edited.TreesBiome
+	if heightMap.Roads != nil {
+		if roads := CreateRoadMesh(&edited, textureContainer, heightMap); len(roads.Vertices) > 0 {
+			remesh.RoadModel = new(gfx.Model)
+			remesh.RoadModel.LoadingData = gfx.FillModelData(&roads)
+		}
+	}
+	chunk.Remesh = remesh
+}
+
+// SwapRemesh replaces the maps, vegetation and road of a chunk with its
+// remesh and returns the previous terrain and road models, for the caller to
+// delete once the new ones are uploaded.
+func (chunk *Chunk) SwapRemesh() []*gfx.Model {
+	remesh := chunk.Remesh
+	old := chunk.TerrainModels()
+	if chunk.RoadModel != nil {
+		old = append(old, chunk.RoadModel)
+	}
+	chunk.Model, chunk.LODModels, chunk.RoadModel = remesh.Model, remesh.LODModels, remesh.RoadModel
+	chunk.Map, chunk.NormalY, chunk.BiomeMap, chunk.Edits = remesh.Map, remesh.NormalY, remesh.BiomeMap, remesh.Edits
+	chunk.GrassTransforms, chunk.TreesTransforms, chunk.TreesBiome = remesh.GrassTransforms, remesh.TreesTransforms, remesh.TreesBiome
+	chunk.HeightRange = remesh.HeightRange
+	chunk.Remesh = nil
+	return old
+}
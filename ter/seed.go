@@ -0,0 +1,37 @@
+package ter
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+)
+
+// DeriveSeed mixes the world seed with a key ("mountainNoise", "trees", ...)
+// so every random source gets its own stream that only depends on the world seed.
+func DeriveSeed(world int64, key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(mix64(uint64(world) ^ h.Sum64()))
+}
+
+// ChunkRand returns a generator keyed by chunk position, so results do not
+// depend on which worker loads the chunk or when.
+func ChunkRand(world int64, position [2]int, stream string) *rand.Rand {
+	key := stream + "/" + strconv.Itoa(position[0]) + "," + strconv.Itoa(position[1])
+	return rand.New(rand.NewSource(DeriveSeed(world, key)))
+}
+
+// noiseSeed folds a derived seed into the int range noiselib hashes with.
+func noiseSeed(world int64, key string) int {
+	return int(int32(DeriveSeed(world, key)))
+}
+
+// splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,299 @@
+package ter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// chunkFileVersion is bumped whenever the chunk file layout or the generator
+// code changes the output, older files are then regenerated.
+const chunkFileVersion = 3 //version 2 rims have no rivers or roads
+
+var chunkFileMagic = [4]byte{'P', 'G', 'C', 'H'}
+
+// ChunkStore keeps generated heightfield chunks on disk, one gzip file per
+// chunk. Files live in a directory named after the generator key, a hash of
+// the seed, the noise graph and every generation parameter, so changing any
+// of them starts from an empty cache.
+type ChunkStore struct {
+	Directory string
+	Key       uint64
+
+	root     string
+	graph    *NoiseGraph
+	failures int32 //consecutive failed saves, see Disabled
+}
+
+// maxSaveFailures failed saves in a row disable the store: a full disk or a
+// removed directory would fail every chunk.
+const maxSaveFailures = 3
+
+// Disabled tells if saves failed too often, the store then neither loads nor
+// saves until it is rekeyed.
+func (store *ChunkStore) Disabled() bool {
+	return atomic.LoadInt32(&store.failures) >= maxSaveFailures
+}
+
+func NewChunkStore(directory string, heightMap *HeightMap, graph *NoiseGraph) (*ChunkStore, error) {
+	store := &ChunkStore{root: directory, graph: graph}
+	if err := store.rekey(heightMap); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// rekey moves the store to the directory of the current generator
+// parameters, after they changed.
+func (store *ChunkStore) rekey(heightMap *HeightMap) error {
+	key, err := generatorKey(heightMap, store.graph)
+	if err != nil {
+		return err
+	}
+	directory := filepath.Join(store.root, strconv.FormatUint(key, 16))
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	store.Key, store.Directory = key, directory
+	atomic.StoreInt32(&store.failures, 0)
+	return nil
+}
+
+func generatorKey(heightMap *HeightMap, graph *NoiseGraph) (uint64, error) {
+	generator := struct {
+		Version        int
+		Seed           int64
+		ChunkNBPoints  uint32
+		ChunkWorldSize uint32
+		Graph          *NoiseGraph
+		Files          map[string]string
+		Erosion        *ErosionParams
+		Thermal        *ThermalParams
+		Rivers         *RiverParams
+		Roads          *RoadParams
+		Wrap           [2]int
+	}{chunkFileVersion, heightMap.Seed, heightMap.ChunkNBPoints, heightMap.ChunkWorldSize, graph, map[string]string{}, heightMap.Erosion, heightMap.Thermal, heightMap.Rivers, heightMap.Roads, heightMap.Wrap}
+
+	//files read by the graph count by size and date
+	for _, node := range graph.Nodes {
+		if node.File == "" {
+			continue
+		}
+		info, err := os.Stat(node.File)
+		if err != nil {
+			return 0, err
+		}
+		generator.Files[node.File] = fmt.Sprint(info.Size(), info.ModTime().UnixNano())
+	}
+
+	data, err := json.Marshal(generator)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64(), nil
+}
+
+func (store *ChunkStore) path(position [2]int) string {
+	return filepath.Join(store.Directory, strconv.Itoa(position[0])+"_"+strconv.Itoa(position[1])+".chunk")
+}
+
+type chunkFileHeader struct {
+	Magic    [4]byte
+	Version  uint32
+	Key      uint64
+	Position [2]int32
+	NBPoints uint32
+}
+
+// Load fills the chunk maps and vegetation transforms from disk. It returns
+// false when there is no valid file for the chunk.
+func (store *ChunkStore) Load(chunk *Chunk) bool {
+	if store.Disabled() {
+		return false
+	}
+	file, err := os.Open(store.path(chunk.Position))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return false
+	}
+
+	var header chunkFileHeader
+	if binary.Read(reader, binary.LittleEndian, &header) != nil {
+		return false
+	}
+	if header.Magic != chunkFileMagic || header.Version != chunkFileVersion || header.Key != store.Key ||
+		header.Position != [2]int32{int32(chunk.Position[0]), int32(chunk.Position[1])} || header.NBPoints != chunk.NBPoints {
+		return false
+	}
+
+	points := int(chunk.NBPoints+1) * int(chunk.NBPoints+1)
+	var maps [4][]float64
+	for i := range maps {
+		if maps[i], err = readFloats(reader, points); err != nil {
+			return false
+		}
+	}
+	rim, err := readFloats(reader, 4*int(chunk.NBPoints+1))
+	if err != nil {
+		return false
+	}
+	biomes, err := readBiomes(reader, points)
+	if err != nil {
+		return false
+	}
+	grass, err := readTransforms(reader)
+	if err != nil {
+		return false
+	}
+	trees, err := readTransforms(reader)
+	if err != nil {
+		return false
+	}
+	treesBiome, err := readBiomes(reader, len(trees))
+	if err != nil {
+		return false
+	}
+
+	chunk.Map, chunk.WaterMap, chunk.LakeMap, chunk.NormalY = maps[0], maps[1], maps[2], maps[3]
+	chunk.Rim = rim
+	chunk.BiomeMap = biomes
+	chunk.GrassTransforms = grass
+	chunk.TreesTransforms = trees
+	chunk.TreesBiome = treesBiome
+	return true
+}
+
+// Save writes the chunk, through a temporary file so a crash or a concurrent
+// reader never sees half a chunk. The error of the save disabling the store
+// says so.
+func (store *ChunkStore) Save(chunk *Chunk) error {
+	if store.Disabled() {
+		return nil
+	}
+	err := store.save(chunk)
+	if err == nil {
+		atomic.StoreInt32(&store.failures, 0)
+	} else if atomic.AddInt32(&store.failures, 1) == maxSaveFailures {
+		err = fmt.Errorf("%v, disabled after %d failures", err, maxSaveFailures)
+	}
+	return err
+}
+
+func (store *ChunkStore) save(chunk *Chunk) error {
+	file, err := ioutil.TempFile(store.Directory, "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	buffered := bufio.NewWriter(file)
+	writer := gzip.NewWriter(buffered)
+	header := chunkFileHeader{
+		Magic:    chunkFileMagic,
+		Version:  chunkFileVersion,
+		Key:      store.Key,
+		Position: [2]int32{int32(chunk.Position[0]), int32(chunk.Position[1])},
+		NBPoints: chunk.NBPoints,
+	}
+	binary.Write(writer, binary.LittleEndian, header)
+	for _, values := range [][]float64{chunk.Map, chunk.WaterMap, chunk.LakeMap, chunk.NormalY, chunk.Rim} {
+		writeFloats(writer, values)
+	}
+	writer.Write(biomeBytes(chunk.BiomeMap))
+	writeTransforms(writer, chunk.GrassTransforms)
+	writeTransforms(writer, chunk.TreesTransforms)
+	writer.Write(biomeBytes(chunk.TreesBiome))
+
+	if err := writer.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), store.path(chunk.Position))
+}
+
+// maps are stored as float32, plenty for rendering and vegetation
+func writeFloats(w io.Writer, values []float64) {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(value)))
+	}
+	w.Write(data)
+}
+
+func readFloats(r io.Reader, count int) ([]float64, error) {
+	data := make([]byte, 4*count)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	values := make([]float64, count)
+	for i := range values {
+		values[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+	}
+	return values, nil
+}
+
+func writeTransforms(w io.Writer, transforms []mgl32.Mat4) {
+	binary.Write(w, binary.LittleEndian, uint32(len(transforms)))
+	binary.Write(w, binary.LittleEndian, transforms)
+}
+
+func readTransforms(r io.Reader) ([]mgl32.Mat4, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	//a corrupted count must not allocate gigabytes
+	if count > 1<<24 {
+		return nil, fmt.Errorf("bad transform count %d", count)
+	}
+	transforms := make([]mgl32.Mat4, count)
+	if err := binary.Read(r, binary.LittleEndian, transforms); err != nil {
+		return nil, err
+	}
+	return transforms, nil
+}
+
+func biomeBytes(biomes []BiomeID) []byte {
+	data := make([]byte, len(biomes))
+	for i, biome := range biomes {
+		data[i] = byte(biome)
+	}
+	return data
+}
+
+func readBiomes(r io.Reader, count int) ([]BiomeID, error) {
+	data := make([]byte, count)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	biomes := make([]BiomeID, count)
+	for i, biome := range data {
+		biomes[i] = BiomeID(biome)
+	}
+	return biomes, nil
+}
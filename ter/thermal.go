@@ -0,0 +1,87 @@
+package ter
+
+import "math"
+
+// ThermalParams configures the thermal weathering pass that moves material
+// downhill wherever the slope is steeper than the talus angle.
+type ThermalParams struct {
+	Iterations int
+	TalusAngle float64 //degrees, measured on the rendered (*2 height) terrain
+	Strength   float64 //fraction of the excess moved per iteration, 0..0.5
+
+	//same meaning as in ErosionParams
+	Padding int
+	Overlap int
+}
+
+func DefaultThermalParams() *ThermalParams {
+	return &ThermalParams{
+		Iterations: 30,
+		TalusAngle: 35.0,
+		Strength:   0.4,
+		Padding:    32,
+		Overlap:    8,
+	}
+}
+
+// thermalNeighbours are the 8 neighbours of a cell, diagonal ones are Sqrt2
+// further away so they allow a larger height difference.
+var thermalNeighbours = [8]struct {
+	x, z     int
+	diagonal bool
+}{
+	{-1, 0, false}, {1, 0, false}, {0, -1, false}, {0, 1, false},
+	{-1, -1, true}, {1, -1, true}, {-1, 1, true}, {1, 1, true},
+}
+
+// ThermalErosion relaxes a size*size heightfield in place. cellSize is the
+// world distance between two samples. Every iteration reads the previous state
+// only, so the result does not depend on the scan order.
+func ThermalErosion(field []float64, size int, cellSize float64, params *ThermalParams) {
+	//rendered heights are doubled, so the allowed difference is halved
+	talus := math.Tan(params.TalusAngle*math.Pi/180.0) * cellSize / 2.0
+	talusDiagonal := talus * math.Sqrt2
+	delta := make([]float64, len(field))
+
+	for iteration := 0; iteration < params.Iterations; iteration++ {
+		for i := range delta {
+			delta[i] = 0
+		}
+		for x := 1; x < size-1; x++ {
+			for z := 1; z < size-1; z++ {
+				i := x + z*size
+				height := field[i]
+
+				var excess [8]float64
+				total := 0.0
+				highest := 0.0
+				for n, neighbour := range thermalNeighbours {
+					limit := talus
+					if neighbour.diagonal {
+						limit = talusDiagonal
+					}
+					diff := height - field[i+neighbour.x+neighbour.z*size] - limit
+					if diff > 0 {
+						excess[n] = diff
+						total += diff
+						highest = math.Max(highest, diff)
+					}
+				}
+				if total == 0 {
+					continue
+				}
+
+				moved := params.Strength * highest
+				delta[i] -= moved
+				for n, neighbour := range thermalNeighbours {
+					if excess[n] > 0 {
+						delta[i+neighbour.x+neighbour.z*size] += moved * excess[n] / total
+					}
+				}
+			}
+		}
+		for i := range field {
+			field[i] += delta[i]
+		}
+	}
+}
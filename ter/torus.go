@@ -0,0 +1,152 @@
+package ter
+
+import (
+	"math"
+
+	"github.com/worldsproject/noiselib"
+)
+
+// TorusNoise replaces the perlin, billow and ridgedmulti generators of a
+// NoiseGraph on wrapping worlds. Each axis with a period is mapped on a
+// circle of that circumference, (x, z) lands on a flat torus in 4D where
+// 4D gradient noise is sampled, so the terrain is continuous across the
+// seam without stretching the features. y is ignored.
+type TorusNoise struct {
+	Type        string //"perlin", "billow" or "ridgedmulti"
+	Seed        int
+	Frequency   float64
+	Lacunarity  float64
+	Persistence float64
+	Gain        float64
+	Offset      float64
+	Exponent    float64
+	OctaveCount int
+	Period      [2]float64 //world units, 0 for an infinite axis
+}
+
+// newTorusNoise copies the parameters of a noiselib generator, other modules
+// are returned untouched.
+func newTorusNoise(module noiselib.Module, period [2]float64) noiselib.Module {
+	switch generator := module.(type) {
+	case noiselib.Perlin:
+		return &TorusNoise{Type: "perlin", Seed: generator.Seed, Frequency: generator.Frequency, Lacunarity: generator.Lacunarity,
+			Persistence: generator.Persistence, OctaveCount: generator.OctaveCount, Period: period}
+	case noiselib.Billow:
+		return &TorusNoise{Type: "billow", Seed: generator.Seed, Frequency: generator.Frequency, Lacunarity: generator.Lacunarity,
+			Persistence: generator.Persistence, OctaveCount: generator.OctaveCount, Period: period}
+	case noiselib.Ridgedmulti:
+		return &TorusNoise{Type: "ridgedmulti", Seed: generator.Seed, Frequency: generator.Frequency, Lacunarity: generator.Lacunarity,
+			Gain: generator.Gain, Offset: generator.Offset, Exponent: generator.Exponent, OctaveCount: generator.OctaveCount, Period: period}
+	}
+	return module
+}
+
+// torusPoint maps a world coordinate on its circle, or on a line for an
+// infinite axis.
+func torusPoint(value float64, period float64) (float64, float64) {
+	if period <= 0 {
+		return value, 0
+	}
+	angle := 2 * math.Pi * value / period
+	radius := period / (2 * math.Pi)
+	return radius * math.Cos(angle), radius * math.Sin(angle)
+}
+
+// GetValue sums the octaves like the noiselib generator of the same type.
+func (torus *TorusNoise) GetValue(x, y, z float64) float64 {
+	a, b := torusPoint(x, torus.Period[0])
+	c, d := torusPoint(z, torus.Period[1])
+	a, b, c, d = a*torus.Frequency, b*torus.Frequency, c*torus.Frequency, d*torus.Frequency
+
+	value := 0.0
+	persistence := 1.0
+	weight := 1.0
+	frequency := 1.0
+	for octave := 0; octave < torus.OctaveCount; octave++ {
+		signal := gradientNoise4(a, b, c, d, uint64(int64(torus.Seed+octave)))
+		switch torus.Type {
+		case "perlin":
+			value += signal * persistence
+		case "billow":
+			value += (2*math.Abs(signal) - 1) * persistence
+		case "ridgedmulti":
+			signal = torus.Offset - math.Abs(signal)
+			signal *= signal * weight
+			weight = math.Max(0, math.Min(1, signal*torus.Gain))
+			value += signal * math.Pow(frequency, -torus.Exponent)
+			//once the weight is 0 the finer octaves add nothing
+			if weight == 0 {
+				return value*1.25 - 1
+			}
+		}
+		a, b, c, d = a*torus.Lacunarity, b*torus.Lacunarity, c*torus.Lacunarity, d*torus.Lacunarity
+		persistence *= torus.Persistence
+		frequency *= torus.Lacunarity
+	}
+
+	switch torus.Type {
+	case "billow":
+		return value + 0.5
+	case "ridgedmulti":
+		return value*1.25 - 1
+	}
+	return value
+}
+
+func (torus *TorusNoise) GetSourceModule(index int) noiselib.Module {
+	return nil
+}
+
+func (torus *TorusNoise) SetSourceModule(index int, sourceModule noiselib.Module) {
+}
+
+func (torus *TorusNoise) SourceModuleCount() int {
+	return 0
+}
+
+// the 32 gradients of 4D Perlin noise, a zero and three ±1 components
+var torusGradients = func() (gradients [32][4]float64) {
+	for index := range gradients {
+		zero := index >> 3
+		sign := uint(0)
+		for i := 0; i < 4; i++ {
+			if i == zero {
+				continue
+			}
+			gradients[index][i] = 1
+			if index>>sign&1 == 1 {
+				gradients[index][i] = -1
+			}
+			sign++
+		}
+	}
+	return
+}()
+
+// gradientNoise4 is 4D Perlin noise, roughly -1..1.
+func gradientNoise4(x, y, z, w float64, seed uint64) float64 {
+	p := [4]float64{x, y, z, w}
+	//per axis hashes and fade weights of the two lattice planes around p
+	var hashes [4][2]uint64
+	var offsets, weights [4][2]float64
+	for i, v := range p {
+		floor := math.Floor(v)
+		f := v - floor
+		fade := f * f * f * (f*(f*6-15) + 10)
+		for bit := 0; bit < 2; bit++ {
+			hashes[i][bit] = mix64((uint64(int64(floor)+int64(bit)) + uint64(i)<<60) ^ seed)
+			offsets[i][bit] = f - float64(bit)
+		}
+		weights[i] = [2]float64{1 - fade, fade}
+	}
+
+	value := 0.0
+	for corner := 0; corner < 16; corner++ {
+		b0, b1, b2, b3 := corner&1, corner>>1&1, corner>>2&1, corner>>3&1
+		h := mix64(hashes[0][b0] ^ hashes[1][b1]*3 ^ hashes[2][b2]*5 ^ hashes[3][b3]*7)
+		g := &torusGradients[h&31]
+		dot := g[0]*offsets[0][b0] + g[1]*offsets[1][b1] + g[2]*offsets[2][b2] + g[3]*offsets[3][b3]
+		value += weights[0][b0] * weights[1][b1] * weights[2][b2] * weights[3][b3] * dot
+	}
+	return value
+}
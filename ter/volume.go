@@ -0,0 +1,282 @@
+package ter
+
+import (
+	"math"
+
+	"../gfx"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// VolumeParams switches chunks from a heightfield to a voxel grid polygonised
+// with surface nets, which allows overhangs, arches and caves. The density of
+// a point is terrain(x,z) - height + Strength*density(x,y,z): positive is
+// solid, so the graph "density" output adds material where it is positive and
+// carves caves where it is negative.
+type VolumeParams struct {
+	CellsPerChunk int     //voxels along a chunk side
+	Layers        int     //voxels along the vertical
+	Bottom        float64 //lowest sampled height, heightmap units, always solid
+	Top           float64 //highest sampled height, always air
+	Strength      float64
+}
+
+func DefaultVolumeParams() *VolumeParams {
+	return &VolumeParams{
+		CellsPerChunk: 64,
+		Layers:        96,
+		Bottom:        -1.5,
+		Top:           3.0,
+		Strength:      0.6,
+	}
+}
+
+// volumeGrid holds the density of a chunk on (cells+2)^2*(layers+1) points,
+// from -1 to cells included horizontally, so the cells along the chunk edge
+// can be polygonised exactly like the neighbouring chunk does.
+type volumeGrid struct {
+	cells   int
+	layers  int
+	side    int
+	cell    float64 //horizontal voxel size, world units
+	layer   float64 //vertical voxel size, heightmap units
+	bottom  float64
+	density []float64
+}
+
+func (grid *volumeGrid) index(x, y, z int) int {
+	return (x + 1) + (z+1)*grid.side + y*grid.side*grid.side
+}
+
+func (grid *volumeGrid) at(x, y, z int) float64 {
+	return grid.density[grid.index(x, y, z)]
+}
+
+func sampleDensity(heightMap *HeightMap, position [2]int, worldSize uint32) *volumeGrid {
+	params := heightMap.Volume
+	grid := &volumeGrid{
+		cells:  params.CellsPerChunk,
+		layers: params.Layers,
+		side:   params.CellsPerChunk + 2,
+		cell:   float64(worldSize) / float64(params.CellsPerChunk),
+		layer:  (params.Top - params.Bottom) / float64(params.Layers),
+		bottom: params.Bottom,
+	}
+	grid.density = make([]float64, grid.side*grid.side*(grid.layers+1))
+
+	for x := -1; x <= grid.cells; x++ {
+		for z := -1; z <= grid.cells; z++ {
+			posX := float64(position[0])*float64(worldSize) + float64(x)*grid.cell
+			posZ := float64(position[1])*float64(worldSize) + float64(z)*grid.cell
+			//the heightfield part is sampled once per column
+			terrain := heightMap.Terrain.GetValue(posX, 0, posZ)
+			for y := 0; y <= grid.layers; y++ {
+				height := grid.bottom + float64(y)*grid.layer
+				density := terrain - height
+				if heightMap.Density != nil {
+					//rendered heights are doubled, keep the noise isotropic on screen
+					density += params.Strength * heightMap.Density.GetValue(posX, 2*height, posZ)
+				}
+				//close the volume so every column has a surface
+				if y == 0 {
+					density = math.Max(density, grid.layer)
+				} else if y == grid.layers {
+					density = math.Min(density, -grid.layer)
+				}
+				grid.density[grid.index(x, y, z)] = density
+			}
+		}
+	}
+	return grid
+}
+
+// surface nets cube corners and edges
+var volumeCorners = [8][3]int{
+	{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {1, 1, 0},
+	{0, 0, 1}, {1, 0, 1}, {0, 1, 1}, {1, 1, 1},
+}
+
+var volumeEdges = [12][2]int{
+	{0, 1}, {2, 3}, {4, 5}, {6, 7},
+	{0, 2}, {1, 3}, {4, 6}, {5, 7},
+	{0, 4}, {1, 5}, {2, 6}, {3, 7},
+}
+
+// polygonise builds the surface nets mesh of the grid, in chunk local
+// coordinates with the same Y conventions as CreateChunkPolyMesh.
+func (grid *volumeGrid) polygonise(heightMap *HeightMap, position [2]int, textureContainer *ChunkTextureContainer) gfx.Mesh {
+	mesh := gfx.Mesh{}
+	cellsX := grid.cells + 1 //cells from -1 to cells-1
+	vertexIndex := make([]int32, cellsX*cellsX*grid.layers)
+	cellIndex := func(x, y, z int) int {
+		return (x + 1) + (z+1)*cellsX + y*cellsX*cellsX
+	}
+
+	var textureID uint32 = 0
+	var textureScale float32 = 1.0 / 16.0
+	worldSize := float64(grid.cells) * grid.cell
+	for y := 0; y < grid.layers; y++ {
+		for x := -1; x < grid.cells; x++ {
+			for z := -1; z < grid.cells; z++ {
+				vertexIndex[cellIndex(x, y, z)] = -1
+				var corners [8]float64
+				solid := 0
+				for i, corner := range volumeCorners {
+					corners[i] = grid.at(x+corner[0], y+corner[1], z+corner[2])
+					if corners[i] > 0 {
+						solid++
+					}
+				}
+				if solid == 0 || solid == 8 {
+					continue
+				}
+
+				//mean of the edge crossings
+				var sum [3]float64
+				crossings := 0
+				for _, edge := range volumeEdges {
+					d0, d1 := corners[edge[0]], corners[edge[1]]
+					if (d0 > 0) == (d1 > 0) {
+						continue
+					}
+					t := d0 / (d0 - d1)
+					for axis := 0; axis < 3; axis++ {
+						c0 := float64(volumeCorners[edge[0]][axis])
+						c1 := float64(volumeCorners[edge[1]][axis])
+						sum[axis] += c0 + (c1-c0)*t
+					}
+					crossings++
+				}
+				localX := (float64(x) + sum[0]/float64(crossings)) * grid.cell
+				height := grid.bottom + (float64(y)+sum[1]/float64(crossings))*grid.layer
+				localZ := (float64(z) + sum[2]/float64(crossings)) * grid.cell
+
+				//density gradient, the normal points to the air
+				gradX := (corners[1] - corners[0] + corners[3] - corners[2] + corners[5] - corners[4] + corners[7] - corners[6]) / (4 * grid.cell)
+				gradY := (corners[2] - corners[0] + corners[3] - corners[1] + corners[6] - corners[4] + corners[7] - corners[5]) / (4 * grid.layer)
+				gradZ := (corners[4] - corners[0] + corners[5] - corners[1] + corners[6] - corners[2] + corners[7] - corners[3]) / (4 * grid.cell)
+				//rendered Y is -2*height
+				normal := mgl32.Vec3{float32(-gradX), float32(gradY / 2), float32(-gradZ)}
+				if normal.Len() > 0 {
+					normal = normal.Normalize()
+				}
+
+				worldX := float64(position[0])*worldSize + localX
+				worldZ := float64(position[1])*worldSize + localZ
+				var temperature, moisture float64
+				if heightMap.Temperature != nil {
+					temperature = heightMap.Temperature.GetValue(worldX, 0, worldZ)
+				}
+				if heightMap.Moisture != nil {
+					moisture = heightMap.Moisture.GetValue(worldX, 0, worldZ)
+				}
+				biome := Biomes[BiomeFor(height, temperature, moisture)]
+				textureID = textureContainer.GroundID(biome.Ground)
+
+				vertexIndex[cellIndex(x, y, z)] = int32(len(mesh.Vertices))
+				mesh.Vertices = append(mesh.Vertices, gfx.Vertex{
+					Position: mgl32.Vec3{float32(localX), float32(-height), float32(localZ)},
+					Normal:   normal,
+					Color:    mgl32.Vec4{biome.Color.X(), biome.Color.Y(), biome.Color.Z(), 0},
+					Texture:  mgl32.Vec2{float32(localX/worldSize) / textureScale, float32(localZ/worldSize) / textureScale},
+				})
+				mesh.Ground = append(mesh.Ground, biome.Ground.Weights())
+			}
+		}
+	}
+
+	//one quad per crossed edge, around the edge. A chunk owns the edges
+	//starting in [0,cells) so shared edges are built once.
+	quad := func(a, b, c, d int, flip bool) {
+		ia, ib, ic, id := vertexIndex[a], vertexIndex[b], vertexIndex[c], vertexIndex[d]
+		if ia < 0 || ib < 0 || ic < 0 || id < 0 {
+			return
+		}
+		if flip {
+			ib, id = id, ib
+		}
+		mesh.Connectivity = append(mesh.Connectivity, gfx.TriangleConnectivity{uint32(ia), uint32(ib), uint32(ic)})
+		mesh.Connectivity = append(mesh.Connectivity, gfx.TriangleConnectivity{uint32(ia), uint32(ic), uint32(id)})
+	}
+	for y := 0; y <= grid.layers; y++ {
+		for x := 0; x < grid.cells; x++ {
+			for z := 0; z < grid.cells; z++ {
+				solid := grid.at(x, y, z) > 0
+				if y > 0 && y < grid.layers {
+					if solid != (grid.at(x+1, y, z) > 0) {
+						quad(cellIndex(x, y-1, z-1), cellIndex(x, y, z-1), cellIndex(x, y, z), cellIndex(x, y-1, z), solid)
+					}
+					if solid != (grid.at(x, y, z+1) > 0) {
+						quad(cellIndex(x-1, y-1, z), cellIndex(x-1, y, z), cellIndex(x, y, z), cellIndex(x, y-1, z), !solid)
+					}
+				}
+				if y < grid.layers && solid != (grid.at(x, y+1, z) > 0) {
+					quad(cellIndex(x-1, y, z-1), cellIndex(x, y, z-1), cellIndex(x, y, z), cellIndex(x-1, y, z), !solid)
+				}
+			}
+		}
+	}
+
+	mesh.TextureID = textureID
+	return mesh
+}
+
+// fillColumns fills chunk.Map with the topmost surface of every grid column,
+// the ground vegetation and the biome map work on.
+func (grid *volumeGrid) fillColumns(chunk *Chunk) {
+	points := grid.cells + 1
+	for x := 0; x < points; x++ {
+		for z := 0; z < points; z++ {
+			height := grid.bottom
+			for y := grid.layers; y > 0; y-- {
+				above, below := grid.at(x, y, z), grid.at(x, y-1, z)
+				if below > 0 && above <= 0 {
+					height = grid.bottom + (float64(y-1)+below/(below-above))*grid.layer
+					break
+				}
+			}
+			chunk.Map[x+z*points] = height
+			chunk.LakeMap[x+z*points] = NoLake
+		}
+	}
+
+	//same normal as CreateChunkPolyMesh, for the vegetation slope test
+	step := grid.cell
+	for x := 0; x < points; x++ {
+		for z := 0; z < points; z++ {
+			left := chunk.Map[maxInt(x-1, 0)+z*points]
+			right := chunk.Map[minInt(x+1, points-1)+z*points]
+			up := chunk.Map[x+maxInt(z-1, 0)*points]
+			down := chunk.Map[x+minInt(z+1, points-1)*points]
+			normal := mgl32.Vec3{float32((right - left) / step), -2, float32((down - up) / step)}
+			chunk.NormalY[x+z*points] = float64(normal.Normalize().Y())
+		}
+	}
+}
+
+// loadVolumeChunk is LoadChunk for voxel chunks. The heightfield passes
+// (erosion, rivers) do not apply, chunk.Map only keeps the top surface at the
+// voxel resolution, so chunk.NBPoints is set to CellsPerChunk.
+func loadVolumeChunk(chunk *Chunk, heightMap *HeightMap, textureContainer *ChunkTextureContainer) {
+	grid := sampleDensity(heightMap, chunk.Position, chunk.WorldSize)
+	//the load queue may have cancelled the chunk, stop between the passes
+	if chunk.Cancelled() {
+		return
+	}
+	chunk.NBPoints = uint32(grid.cells)
+	points := (grid.cells + 1) * (grid.cells + 1)
+	chunk.Map = make([]float64, points)
+	chunk.WaterMap = make([]float64, points)
+	chunk.LakeMap = make([]float64, points)
+	chunk.NormalY = make([]float64, points)
+	grid.fillColumns(chunk)
+	//caves go down to the bottom of the grid
+	chunk.HeightRange = [2]float64{heightMap.Volume.Bottom, heightMap.Volume.Top}
+	fillBiomeMap(chunk, heightMap)
+
+	mesh := grid.polygonise(heightMap, chunk.Position, textureContainer)
+	chunk.Model = new(gfx.Model)
+	chunk.Model.LoadingData = gfx.FillModelData(&mesh)
+
+	chunk.GrassTransforms = getGrassTransforms(chunk, heightMap.Seed)
+	chunk.TreesTransforms, chunk.TreesBiome = getTreesTransforms(chunk, heightMap.Seed, nil)
+}
@@ -0,0 +1,75 @@
+package ter
+
+import (
+	"github.com/worldsproject/noiselib"
+)
+
+// Warp samples its source at (x, z) moved by the output of other modules,
+// domain warping as described by Inigo Quilez. With Iterations > 1 the offset
+// is itself computed at the warped position, f(p + w(p + w(p))). WarpZ may be
+// nil, WarpX is then sampled a second time far away for the z offset.
+type Warp struct {
+	Source noiselib.Module
+	WarpX  noiselib.Module
+	WarpZ  noiselib.Module
+
+	Frequency  float64 //scales the coordinates the warp modules see
+	Strength   float64 //world units for a warp module output of 1
+	Iterations int
+}
+
+func DefaultWarp() *Warp {
+	return &Warp{Frequency: 1.0, Strength: 4.0, Iterations: 1}
+}
+
+// warp offsets, decorrelating the x and z samples and every iteration. They
+// are added after Frequency, in the space the warp modules see, so they do not
+// shrink with it. Modules scale them again by their own frequency, hence the
+// size: 0.03 still leaves them 15 noise cells apart.
+var warpOffsets = [][2][2]float64{
+	{{0, 0}, {521.3, 133.7}},
+	{{171.9, 919.1}, {829.3, 283.9}},
+	{{409.7, 673.3}, {991.1, 347.9}},
+}
+
+func (warp *Warp) GetValue(x, y, z float64) float64 {
+	dx, dz := 0.0, 0.0
+	for i := 0; i < warp.Iterations; i++ {
+		offsets := warpOffsets[i%len(warpOffsets)]
+		px, pz := (x+dx)*warp.Frequency, (z+dz)*warp.Frequency
+		warpX := warp.WarpX.GetValue(px+offsets[0][0], y*warp.Frequency, pz+offsets[0][1])
+		var warpZ float64
+		if warp.WarpZ != nil {
+			warpZ = warp.WarpZ.GetValue(px+offsets[1][0], y*warp.Frequency, pz+offsets[1][1])
+		} else {
+			warpZ = warp.WarpX.GetValue(px+offsets[1][0], y*warp.Frequency, pz+offsets[1][1])
+		}
+		dx, dz = warp.Strength*warpX, warp.Strength*warpZ
+	}
+	return warp.Source.GetValue(x+dx, y, z+dz)
+}
+
+func (warp *Warp) GetSourceModule(index int) noiselib.Module {
+	switch index {
+	case 1:
+		return warp.WarpX
+	case 2:
+		return warp.WarpZ
+	}
+	return warp.Source
+}
+
+func (warp *Warp) SetSourceModule(index int, sourceModule noiselib.Module) {
+	switch index {
+	case 1:
+		warp.WarpX = sourceModule
+	case 2:
+		warp.WarpZ = sourceModule
+	default:
+		warp.Source = sourceModule
+	}
+}
+
+func (warp *Warp) SourceModuleCount() int {
+	return 3
+}
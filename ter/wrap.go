@@ -0,0 +1,38 @@
+package ter
+
+import "math"
+
+// Wrapping worlds are HeightMap.Wrap chunks wide on each axis with a non zero
+// size. Chunks are keyed and generated by their wrapped position, in
+// [0, Wrap), and drawn at the copy around the camera, Chunk.DrawPosition.
+
+// WrapChunk returns the position of the chunk covering a chunk position.
+func (heightMap *HeightMap) WrapChunk(position [2]int) [2]int {
+	for axis, size := range heightMap.Wrap {
+		if size > 0 {
+			position[axis] = position[axis] - floorDiv(position[axis], size)*size
+		}
+	}
+	return position
+}
+
+// WrapWorld brings world coordinates back into the world, it returns whether
+// they moved.
+func (heightMap *HeightMap) WrapWorld(x, z float64) (float64, float64, bool) {
+	period := heightMap.Period()
+	wrapped := [2]float64{x, z}
+	for axis, size := range period {
+		if size > 0 {
+			wrapped[axis] -= math.Floor(wrapped[axis]/size) * size
+		}
+	}
+	return wrapped[0], wrapped[1], wrapped != [2]float64{x, z}
+}
+
+// Period returns the world size in world units, 0 for an infinite axis.
+func (heightMap *HeightMap) Period() [2]float64 {
+	return [2]float64{
+		float64(heightMap.Wrap[0]) * float64(heightMap.ChunkWorldSize),
+		float64(heightMap.Wrap[1]) * float64(heightMap.ChunkWorldSize),
+	}
+}
@@ -10,16 +10,31 @@ import (
 )
 
 type Gaia struct {
+	Seed          int64
 	InstanceTrees [][2]*InstanceTree
 	InstanceGrass *InstanceGrass
+
+	species [][]int //tree models per biome, see speciesTables
+	groups  map[*ter.Chunk]*vegetationGroup
+	drawn   []*ter.Chunk //chunks in the instances, nil to fill them again
+}
+
+// vegetationGroup holds the instances of one chunk, its trees per species and
+// quality like InstanceTrees.
+type vegetationGroup struct {
+	grass []mgl32.Mat4
+	trees [][2][]mgl32.Mat4
 }
 
-func InitialiseVegetation(step float32) *Gaia {
-	uniqueTrees := createUniqueTrees()
-	uniqueGrass := createUniqueGrass(step)
+func InitialiseVegetation(step float32, seed int64) *Gaia {
+	rng := rand.New(rand.NewSource(ter.DeriveSeed(seed, "species")))
+	uniqueTrees := createUniqueTrees(rng)
+	uniqueGrass := createUniqueGrass(step, rng)
 	return &Gaia{
+		Seed:          seed,
 		InstanceGrass: getInstanceGrass(uniqueGrass),
 		InstanceTrees: getInstanceTrees(uniqueTrees),
+		species:       speciesTables(),
 	}
 }
 
@@ -45,34 +60,14 @@ func getInstanceTrees(uniqueTrees [][2]*Tree) [][2]*InstanceTree {
 }
 
 func (g *Gaia) CreateChunkVegetation(chunk *ter.Chunk, currentChunk [2]int) {
-	// start := time.Now()
-	chunk.IsHQ = isCloseToCurrentChunk(chunk, currentChunk)
-	if chunk.IsHQ {
-		g.InstanceGrass.Transforms = append(g.InstanceGrass.Transforms, chunk.GrassTransforms...)
-		gfx.ModelToInstanceModel(g.InstanceGrass.Model, g.InstanceGrass.Transforms)
-	}
-	for _, transform := range chunk.TreesTransforms {
-		index := rand.Intn(len(g.InstanceTrees))
-		chunk.TreesModelID = append(chunk.TreesModelID, index)
-		if chunk.IsHQ {
-			g.InstanceTrees[index][0].Transforms = append(g.InstanceTrees[index][0].Transforms, transform)
-		} else {
-			g.InstanceTrees[index][1].Transforms = append(g.InstanceTrees[index][1].Transforms, transform)
-		}
-
-	}
-	for _, instanceTree := range g.InstanceTrees {
-		gfx.ModelToInstanceModel(instanceTree[0].BranchesModel, instanceTree[0].Transforms)
-		gfx.ModelToInstanceModel(instanceTree[0].LeavesModel, instanceTree[0].Transforms)
-		gfx.ModelToInstanceModel(instanceTree[1].BranchesModel, instanceTree[1].Transforms)
-		gfx.ModelToInstanceModel(instanceTree[1].LeavesModel, instanceTree[1].Transforms)
+	rng := ter.ChunkRand(g.Seed, chunk.Position, "species")
+	chunk.TreesModelID = nil
+	for i := range chunk.TreesTransforms {
+		species := g.species[chunk.TreesBiome[i]]
+		chunk.TreesModelID = append(chunk.TreesModelID, species[rng.Intn(len(species))])
 	}
-	// fmt.Println(
-	// 	"new chunk", time.Now().Sub(start),
-	// 	"grass:", len(chunk.GrassTransforms),
-	// 	"trees:", len(chunk.TreesTransforms),
-	// )
 	chunk.HasVegetation = true
+	g.groupChunk(chunk, currentChunk)
 }
 
 func (g *Gaia) ResetInstanceTransfoms() {
@@ -83,45 +78,117 @@ func (g *Gaia) ResetInstanceTransfoms() {
 	}
 }
 
+// RedrawAllChunks groups the vegetation of the chunks around the camera again,
+// close chunks get the grass and the detailed trees. Cull picks the groups drawn.
 func (g *Gaia) RedrawAllChunks(chunks []*ter.Chunk, currentChunk [2]int) {
-	// start := time.Now()
+	g.groups = make(map[*ter.Chunk]*vegetationGroup)
+	g.drawn = nil
 	for _, chunk := range chunks {
 		chunk.IsHQ = isCloseToCurrentChunk(chunk, currentChunk)
-		if !chunk.HasVegetation {
-			continue
+		if chunk.HasVegetation {
+			g.groupChunk(chunk, currentChunk)
+		}
+	}
+}
+
+// groupChunk builds the vegetation instances of a chunk.
+func (g *Gaia) groupChunk(chunk *ter.Chunk, currentChunk [2]int) {
+	chunk.IsHQ = isCloseToCurrentChunk(chunk, currentChunk)
+	group := &vegetationGroup{trees: make([][2][]mgl32.Mat4, len(g.InstanceTrees))}
+	if chunk.IsHQ {
+		group.grass = drawTransforms(chunk, chunk.GrassTransforms)
+	}
+	quality := 1
+	if chunk.IsHQ {
+		quality = 0
+	}
+	for i, transform := range drawTransforms(chunk, chunk.TreesTransforms) {
+		index := chunk.TreesModelID[i]
+		group.trees[index][quality] = append(group.trees[index][quality], transform)
+	}
+	if g.groups == nil {
+		g.groups = make(map[*ter.Chunk]*vegetationGroup)
+	}
+	g.groups[chunk] = group
+	g.drawn = nil
+}
+
+// Cull fills the instances with the groups of the visible chunks, only when
+// they changed. Groups of chunks off screen are skipped whole.
+func (g *Gaia) Cull(visible []*ter.Chunk) {
+	if g.drawn != nil && len(g.drawn) == len(visible) {
+		same := true
+		for i, chunk := range visible {
+			same = same && g.drawn[i] == chunk
 		}
-		if chunk.IsHQ {
-			g.InstanceGrass.Transforms = append(g.InstanceGrass.Transforms, chunk.GrassTransforms...)
+		if same {
+			return
 		}
-		for i, transform := range chunk.TreesTransforms {
-			index := chunk.TreesModelID[i]
-			if chunk.IsHQ {
-				g.InstanceTrees[index][0].Transforms = append(g.InstanceTrees[index][0].Transforms, transform)
-			} else {
-				g.InstanceTrees[index][1].Transforms = append(g.InstanceTrees[index][1].Transforms, transform)
-			}
+	}
+	g.drawn = append([]*ter.Chunk{}, visible...)
+
+	g.ResetInstanceTransfoms()
+	for _, chunk := range visible {
+		group := g.groups[chunk]
+		if group == nil {
+			continue
+		}
+		g.InstanceGrass.Transforms = append(g.InstanceGrass.Transforms, group.grass...)
+		for index, instanceTree := range g.InstanceTrees {
+			instanceTree[0].Transforms = append(instanceTree[0].Transforms, group.trees[index][0]...)
+			instanceTree[1].Transforms = append(instanceTree[1].Transforms, group.trees[index][1]...)
 		}
 	}
 
 	gfx.ModelToInstanceModel(g.InstanceGrass.Model, g.InstanceGrass.Transforms)
-	nbrTrees := 0
 	for _, instanceTree := range g.InstanceTrees {
 		gfx.ModelToInstanceModel(instanceTree[0].BranchesModel, instanceTree[0].Transforms)
 		gfx.ModelToInstanceModel(instanceTree[0].LeavesModel, instanceTree[0].Transforms)
 		gfx.ModelToInstanceModel(instanceTree[1].BranchesModel, instanceTree[1].Transforms)
 		gfx.ModelToInstanceModel(instanceTree[1].LeavesModel, instanceTree[1].Transforms)
-		nbrTrees += len(instanceTree[0].Transforms) + len(instanceTree[1].Transforms)
 	}
-	// fmt.Println(
-	// 	"redraw all", time.Now().Sub(start),
-	// 	"grass:", len(g.InstanceGrass.Transforms),
-	// 	"trees:", nbrTrees,
-	// )
+}
+
+// speciesTables lists the tree models growing in every biome. Biomes no
+// species grows in, where trees can still be planted by hand, get them all.
+func speciesTables() [][]int {
+	tables := make([][]int, len(ter.Biomes))
+	for index, species := range treeSpeciesList {
+		for _, biome := range species.biomes {
+			for variant := 0; variant < treeVariants; variant++ {
+				tables[biome] = append(tables[biome], index*treeVariants+variant)
+			}
+		}
+	}
+	for biome := range tables {
+		if len(tables[biome]) == 0 {
+			for model := 0; model < len(treeSpeciesList)*treeVariants; model++ {
+				tables[biome] = append(tables[biome], model)
+			}
+		}
+	}
+	return tables
+}
+
+// drawTransforms moves the vegetation of a chunk drawn away from its position,
+// on wrapping worlds.
+func drawTransforms(chunk *ter.Chunk, transforms []mgl32.Mat4) []mgl32.Mat4 {
+	if chunk.DrawPosition == chunk.Position {
+		return transforms
+	}
+	shift := mgl32.Translate3D(
+		float32(chunk.DrawPosition[0]-chunk.Position[0])*float32(chunk.WorldSize), 0,
+		float32(chunk.DrawPosition[1]-chunk.Position[1])*float32(chunk.WorldSize))
+	moved := make([]mgl32.Mat4, len(transforms))
+	for i, transform := range transforms {
+		moved[i] = shift.Mul4(transform)
+	}
+	return moved
 }
 
 func isCloseToCurrentChunk(chunk *ter.Chunk, currentChunk [2]int) bool {
-	if math.Abs(float64(chunk.Position[0]-currentChunk[0])) <= 1 &&
-		math.Abs(float64(chunk.Position[1]-currentChunk[1])) <= 1 {
+	if math.Abs(float64(chunk.DrawPosition[0]-currentChunk[0])) <= 1 &&
+		math.Abs(float64(chunk.DrawPosition[1]-currentChunk[1])) <= 1 {
 		return true
 	}
 	return false
@@ -12,12 +12,12 @@ type InstanceGrass struct {
 	Transforms []mgl32.Mat4
 }
 
-func createUniqueGrass(step float32) *gfx.Model {
+func createUniqueGrass(step float32, rng *rand.Rand) *gfx.Model {
 	mesh := gfx.Mesh{}
 	width := step
 	height := float32(-0.050)
 	index := uint32(0)
-	angle := 360.0 * rand.Float32()
+	angle := 360.0 * rng.Float32()
 	p1 := rotateY(angle, mgl32.Vec3{0, 0, 0.0})
 	p2 := rotateY(angle, mgl32.Vec3{width / 2.0, height, 0.0})
 	p3 := rotateY(angle, mgl32.Vec3{width, 0, 0.0})
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"../gfx"
+	"../ter"
 
 	"github.com/go-gl/mathgl/mgl32"
 )
@@ -19,6 +20,7 @@ type Tree struct {
 	colorBranches mgl32.Vec4
 	colorLeaves   mgl32.Vec4
 	position      mgl32.Vec3
+	rng           *rand.Rand
 	BranchesModel *gfx.Model
 	LeavesModel   *gfx.Model
 }
@@ -38,44 +40,51 @@ type InstanceTree struct {
 	Transforms    []mgl32.Mat4
 }
 
-func createUniqueTrees() [][2]*Tree {
+// treeSpecies is a kind of tree: its grammar rule, branch angle and leaves
+// color, and the biomes it grows in. Each one gets treeVariants models.
+type treeSpecies struct {
+	rule   string
+	angle  float32
+	leaves mgl32.Vec4
+	biomes []ter.BiomeID
+}
+
+var treeSpeciesList = []treeSpecies{
+	{"F[+F]F[-F]F", 12, mgl32.Vec4{0.05, 0.35, 0.15, 0.0}, []ter.BiomeID{ter.BiomeTundra, ter.BiomeTaiga, ter.BiomeTemperateRainforest}},
+	{"F[+FF]F[-F]", 22, mgl32.Vec4{0.2, 0.6, 0.1, 0.0}, []ter.BiomeID{ter.BiomeGrassland, ter.BiomeTemperateForest, ter.BiomeTemperateRainforest}},
+	{"F[+F][-FF]F", 35, mgl32.Vec4{0.45, 0.5, 0.1, 0.0}, []ter.BiomeID{ter.BiomeGrassland, ter.BiomeSavanna, ter.BiomeDesert}},
+	{"F[-F]F[+F][F]", 25, mgl32.Vec4{0.05, 0.55, 0.05, 0.0}, []ter.BiomeID{ter.BiomeTropicalForest, ter.BiomeRainforest}},
+}
+
+const treeVariants = 5
+
+// createUniqueTrees builds the variants of every species in a row, species s
+// owns the models from s*treeVariants.
+func createUniqueTrees(rng *rand.Rand) [][2]*Tree {
 	var uniqueTrees [][2]*Tree
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+FF]F[-F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[-F]F[+F][F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F][-FF]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F]F[-F]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+FF]F[-F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[-F]F[+F][F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F][-FF]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F]F[-F]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+FF]F[-F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[-F]F[+F][F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F][-FF]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F]F[-F]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+FF]F[-F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[-F]F[+F][F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F][-FF]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F]F[-F]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+FF]F[-F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[-F]F[+F][F]"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F][-FF]F"))
-	uniqueTrees = append(uniqueTrees, createTreePair("F[+F]F[-F]F"))
+	for _, species := range treeSpeciesList {
+		for variant := 0; variant < treeVariants; variant++ {
+			uniqueTrees = append(uniqueTrees, createTreePair(rng, species))
+		}
+	}
 	return uniqueTrees
 }
 
-func createTreePair(rule string) [2]*Tree {
-	random := rand.Float32()
-	return [2]*Tree{createTreeHQ(rule, random), createTreeLQ(random)}
+func createTreePair(rng *rand.Rand, species treeSpecies) [2]*Tree {
+	random := rng.Float32()
+	leaves := species.leaves.Mul(0.5 + random/2)
+	return [2]*Tree{createTreeHQ(rng, species, random, leaves), createTreeLQ(rng, random, leaves)}
 }
 
-func createTreeHQ(rule string, random float32) *Tree {
+func createTreeHQ(rng *rand.Rand, species treeSpecies, random float32, leaves mgl32.Vec4) *Tree {
 	tree := &Tree{
-		rule:          rule,
-		angle:         15.0 + rand.Float32()*15.0,
+		rng:           rng,
+		rule:          species.rule,
+		angle:         species.angle + rng.Float32()*10.0,
 		grammar:       "F",
 		axiom:         "F",
 		colorBranches: mgl32.Vec4{0.5, 0.5, 0.1, 0.0}.Mul(random),
-		colorLeaves:   mgl32.Vec4{0.0, random, 0.0, 0.0},
+		colorLeaves:   leaves,
 	}
 
 	for index := 0; index < 2; index++ {
@@ -89,10 +98,11 @@ func createTreeHQ(rule string, random float32) *Tree {
 	return tree
 }
 
-func createTreeLQ(random float32) *Tree {
+func createTreeLQ(rng *rand.Rand, random float32, leaves mgl32.Vec4) *Tree {
 	tree := &Tree{
+		rng:           rng,
 		colorBranches: mgl32.Vec4{0.5, 0.5, 0.1, 0.0}.Mul(random),
-		colorLeaves:   mgl32.Vec4{0.0, random, 0.0, 0.0},
+		colorLeaves:   leaves,
 	}
 	branches := []Branch{Branch{radius: 0.001, height: -0.05}}
 	tree.createBranchesModel(branches)
@@ -108,7 +118,7 @@ func (t *Tree) createLeavesModel(branches []Branch, customSizeLeaves ...float32)
 
 	for _, branch := range branches {
 		dr := 180.0 / (nbRadius)
-		offsetRotY := rand.Float32() * 360.0
+		offsetRotY := t.rng.Float32() * 360.0
 		sizeLeaves := (branch.position.Y()) / 2.0
 
 		if len(customSizeLeaves) > 0 {
@@ -186,7 +196,7 @@ func (t *Tree) generateFromGrammar() {
 	rootBranches := []Branch{}
 	branches := []Branch{}
 	leaves := []Branch{}
-	size := 1.0 + rand.Float32()*9.0
+	size := 1.0 + t.rng.Float32()*9.0
 	branch := Branch{radius: 0.005 * size, height: -0.05}
 	addSomething := false
 
@@ -225,7 +235,7 @@ func (t *Tree) generateFromGrammar() {
 			break
 		case "[":
 			if len(rootBranches) == 0 {
-				branch.angleY += float32(rand.Float64() * 360.0)
+				branch.angleY += float32(t.rng.Float64() * 360.0)
 			}
 			rootBranches = append(rootBranches, branch) //push
 			break
@@ -16,6 +16,23 @@ const (
 	PlayerRight    ActionKey = iota
 	ProgramQuit    ActionKey = iota
 	PlayerSlow     ActionKey = iota
+	ProgramExport  ActionKey = iota
+	ProgramSave    ActionKey = iota
+	BrushRaise     ActionKey = iota
+	BrushLower     ActionKey = iota
+	BrushFlatten   ActionKey = iota
+	BrushSmooth    ActionKey = iota
+	BrushNoise     ActionKey = iota
+	BrushGrow      ActionKey = iota
+	BrushShrink    ActionKey = iota
+	ProgramControl ActionKey = iota
+	ProgramUndo    ActionKey = iota
+	ProgramRedo    ActionKey = iota
+	TreePlace      ActionKey = iota
+	TreeRemove     ActionKey = iota
+	ParamNext      ActionKey = iota
+	ParamUp        ActionKey = iota
+	ParamDown      ActionKey = iota
 )
 
 // ActionButton is a configurable abstraction of a mouse button press
@@ -33,10 +50,13 @@ type InputManager struct {
 	actionToKeyMap    map[ActionKey]glfw.Key
 	actionToButtonMap map[ActionButton]glfw.MouseButton
 
-	keysPressed    [glfw.KeyLast]bool
-	buttonsPressed [glfw.MouseButtonLast]bool
+	keysPressed      [glfw.KeyLast]bool
+	keysTriggered    [glfw.KeyLast]bool
+	buttonsPressed   [glfw.MouseButtonLast]bool
+	buttonsTriggered [glfw.MouseButtonLast]bool
 
 	firstCursorAction    bool
+	cursorPosition       mgl64.Vec2
 	cursor               mgl64.Vec2
 	cursorChange         mgl64.Vec2
 	cursorLast           mgl64.Vec2
@@ -52,6 +72,23 @@ func NewInputManager() *InputManager {
 		PlayerRight:    glfw.KeyD,
 		ProgramQuit:    glfw.KeyEscape,
 		PlayerSlow:     glfw.KeyLeftShift,
+		ProgramExport:  glfw.KeyF5,
+		ProgramSave:    glfw.KeyF6,
+		BrushRaise:     glfw.Key1,
+		BrushLower:     glfw.Key2,
+		BrushFlatten:   glfw.Key3,
+		BrushSmooth:    glfw.Key4,
+		BrushNoise:     glfw.Key5,
+		BrushGrow:      glfw.KeyRightBracket,
+		BrushShrink:    glfw.KeyLeftBracket,
+		ProgramControl: glfw.KeyLeftControl,
+		ProgramUndo:    glfw.KeyZ,
+		ProgramRedo:    glfw.KeyY,
+		TreePlace:      glfw.KeyT,
+		TreeRemove:     glfw.KeyX,
+		ParamNext:      glfw.KeyTab,
+		ParamUp:        glfw.KeyEqual,
+		ParamDown:      glfw.KeyMinus,
 	}
 
 	actionToButtonMap := map[ActionButton]glfw.MouseButton{
@@ -72,11 +109,33 @@ func (im *InputManager) IsKeyActive(a ActionKey) bool {
 	return im.keysPressed[im.actionToKeyMap[a]]
 }
 
+// IsKeyTriggered returns whether the given Action was pressed since the last call,
+// for one shot actions
+func (im *InputManager) IsKeyTriggered(a ActionKey) bool {
+	key := im.actionToKeyMap[a]
+	triggered := im.keysTriggered[key]
+	im.keysTriggered[key] = false
+	return triggered
+}
+
 // IsButtonActive returns whether the given ActionButton is currently active
 func (im *InputManager) IsButtonActive(a ActionButton) bool {
 	return im.buttonsPressed[im.actionToButtonMap[a]]
 }
 
+// IsButtonTriggered returns whether the given ActionButton was pressed since the last call
+func (im *InputManager) IsButtonTriggered(a ActionButton) bool {
+	button := im.actionToButtonMap[a]
+	triggered := im.buttonsTriggered[button]
+	im.buttonsTriggered[button] = false
+	return triggered
+}
+
+// CursorPosition returns where the cursor is in the window, in pixels, whatever the buttons
+func (im *InputManager) CursorPosition() mgl64.Vec2 {
+	return im.cursorPosition
+}
+
 // Cursor returns the value of the cursor at the last time that CheckpointCursorChange() was called.
 func (im *InputManager) Cursor() mgl64.Vec2 {
 	return im.cursor
@@ -108,6 +167,7 @@ func (im *InputManager) keyCallback(window *glfw.Window, key glfw.Key, scancode
 	switch action {
 	case glfw.Press:
 		im.keysPressed[key] = true
+		im.keysTriggered[key] = true
 	case glfw.Release:
 		im.keysPressed[key] = false
 	}
@@ -118,6 +178,7 @@ func (im *InputManager) mouseButtonCallback(w *glfw.Window, button glfw.MouseBut
 	switch action {
 	case glfw.Press:
 		im.buttonsPressed[button] = true
+		im.buttonsTriggered[button] = true
 	case glfw.Release:
 		im.buttonsPressed[button] = false
 	}
@@ -133,6 +194,8 @@ func (im *InputManager) mouseButtonCallback(w *glfw.Window, button glfw.MouseBut
 }
 
 func (im *InputManager) mouseCallback(window *glfw.Window, xpos, ypos float64) {
+	im.cursorPosition[0] = xpos
+	im.cursorPosition[1] = ypos
 
 	if !im.IsButtonActive(MouseLeft) {
 		return